@@ -0,0 +1,139 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	funcv1 "github.com/yaron2/azfuncs/pkg/apis/azurefunctions/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// functionURL returns the URL the function is reachable at, through its first
+// route when it is routed. While no address has been assigned yet it returns
+// an empty URL and the reason it is pending
+func (t *AzureFunctionsHandler) functionURL(function *funcv1.AzureFunction, service *apiv1.Service, ingressEnabled bool, routes []functionRoute) (string, string, error) {
+	if !ingressEnabled && function.Spec.AccessPolicy == funcv1.AccessPolicyPrivate {
+		if service.Spec.ClusterIP == "" {
+			return "", "WaitingForClusterIP", nil
+		}
+
+		return "http://" + service.Spec.ClusterIP, "", nil
+	}
+
+	if !ingressEnabled {
+		address, err := t.serviceAddress(service)
+		if err != nil || address == "" {
+			return "", "WaitingForLoadBalancer", err
+		}
+
+		return "http://" + address, "", nil
+	}
+
+	if len(routes) == 0 {
+		return "", reasonRouteConflict, nil
+	}
+
+	route := routes[0].Path
+
+	externalBaseURL := t.Config.Get().ExternalBaseURL
+	if externalBaseURL != "" {
+		return strings.TrimSuffix(externalBaseURL, "/") + route, "", nil
+	}
+
+	if routes[0].Host != "" {
+		return "http://" + routes[0].Host + route, "", nil
+	}
+
+	ingressComponent := t.ConfiguredIngressComponent()
+	ingressService, err := t.IngressServiceLister.Services(ingressComponent.Namespace()).Get(ingressComponent.ServiceName())
+	if err != nil {
+		return "", "", err
+	}
+
+	address, err := t.serviceAddress(ingressService)
+	if err != nil || address == "" {
+		return "", "WaitingForIngressAddress", err
+	}
+
+	return "http://" + address + route, "", nil
+}
+
+// serviceAddress returns the address a service is reachable at from outside
+// of the cluster. Load balancers may report either an IP or a hostname
+func (t *AzureFunctionsHandler) serviceAddress(service *apiv1.Service) (string, error) {
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			return ingress.IP, nil
+		}
+
+		if ingress.Hostname != "" {
+			return ingress.Hostname, nil
+		}
+	}
+
+	if !t.Config.Get().NodePortFallback {
+		return "", nil
+	}
+
+	nodePort := int32(0)
+	for _, port := range service.Spec.Ports {
+		if port.NodePort != 0 && (nodePort == 0 || port.Port == servicePort) {
+			nodePort = port.NodePort
+		}
+	}
+
+	if nodePort == 0 {
+		return "", nil
+	}
+
+	address, err := t.nodeAddress()
+	if err != nil || address == "" {
+		return "", err
+	}
+
+	return address + ":" + strconv.Itoa(int(nodePort)), nil
+}
+
+// nodeAddress returns the external address of a ready node, or its internal
+// address when no node has an external one
+func (t *AzureFunctionsHandler) nodeAddress() (string, error) {
+	nodes, err := t.NodesLister.List(labels.Everything())
+	if err != nil {
+		return "", err
+	}
+
+	// the cache isn't ordered, and the URL of the function shouldn't change
+	// from one reconcile to the next
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+
+	internal := ""
+	for _, node := range nodes {
+		if !isNodeReady(node) {
+			continue
+		}
+
+		for _, address := range node.Status.Addresses {
+			if address.Type == apiv1.NodeExternalIP {
+				return address.Address, nil
+			}
+
+			if address.Type == apiv1.NodeInternalIP && internal == "" {
+				internal = address.Address
+			}
+		}
+	}
+
+	return internal, nil
+}
+
+func isNodeReady(node *apiv1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == apiv1.NodeReady {
+			return condition.Status == apiv1.ConditionTrue
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/yaron2/azfuncs/config"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newNode(name string, ready bool, addresses ...apiv1.NodeAddress) *apiv1.Node {
+	status := apiv1.ConditionFalse
+	if ready {
+		status = apiv1.ConditionTrue
+	}
+
+	return &apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: apiv1.NodeStatus{
+			Conditions: []apiv1.NodeCondition{{Type: apiv1.NodeReady, Status: status}},
+			Addresses:  addresses,
+		},
+	}
+}
+
+// TestServiceAddressFallsBackToNodePort checks that the node address is read
+// from the cache of nodes, preferring the external address of a ready node
+func TestServiceAddressFallsBackToNodePort(t *testing.T) {
+	e := newTestEnv(t,
+		newNode("node-a", false, apiv1.NodeAddress{Type: apiv1.NodeExternalIP, Address: "20.0.0.1"}),
+		newNode("node-b", true, apiv1.NodeAddress{Type: apiv1.NodeInternalIP, Address: "10.1.0.2"}),
+		newNode("node-c", true,
+			apiv1.NodeAddress{Type: apiv1.NodeInternalIP, Address: "10.1.0.3"},
+			apiv1.NodeAddress{Type: apiv1.NodeExternalIP, Address: "20.0.0.3"}),
+	)
+
+	cfg := config.Default()
+	cfg.NodePortFallback = true
+	e.handler.Config.Set(cfg)
+
+	e.sync()
+	e.kube.ClearActions()
+
+	service := &apiv1.Service{
+		Spec: apiv1.ServiceSpec{
+			Ports: []apiv1.ServicePort{{Port: servicePort, NodePort: 30080}},
+		},
+	}
+
+	address, err := e.handler.serviceAddress(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if address != "20.0.0.3:30080" {
+		t.Errorf("expected the external address of the ready node, got %q", address)
+	}
+
+	if actions := e.kube.Actions(); len(actions) != 0 {
+		t.Errorf("expected the nodes to be read from the cache, got %v", actions)
+	}
+}
@@ -14,3 +14,9 @@ cd $GOPATH/src/k8s.io/code-generator
 
 # view the newly generated files
 #tree $GOPATH/src/$ROOT_PACKAGE/pkg/client
+
+# generate the CRD manifest, including the OpenAPI validation schema and
+# server-side defaults, from the kubebuilder markers in the API types
+go get -u sigs.k8s.io/controller-tools/cmd/controller-gen
+cd $GOPATH/src/$ROOT_PACKAGE
+controller-gen crd:crdVersions=v1 paths=./pkg/apis/... output:crd:stdout > ./deploy/azurefunctions-crd.yaml
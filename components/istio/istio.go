@@ -1,15 +1,45 @@
 package istio
 
 import (
+	"fmt"
+
 	"github.com/mholt/archiver"
 	"github.com/yaron2/azfuncs/components"
+	funcv1 "github.com/yaron2/azfuncs/pkg/apis/azurefunctions/v1"
 	"github.com/yaron2/azfuncs/utils"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 )
 
 const releaseURL = "https://github.com/istio/istio/releases/download/1.0.0/istio-1.0.0-linux.tar.gz"
 
-type IstioComponent struct{}
+const (
+	// injectAnnotation asks the sidecar injector for a sidecar in a pod
+	injectAnnotation = "sidecar.istio.io/inject"
+
+	// injectionLabel is the namespace label the sidecar injector of Istio
+	// 1.0 selects namespaces by
+	injectionLabel = "istio-injection"
+
+	// labeledAnnotation marks the namespaces whose injection label was added
+	// by the controller, so it is never removed from any other namespace
+	labeledAnnotation = "azurefunctions.dev.azure.com/istio-injection"
+
+	// the labels the controller sets on the resources of every function
+	managedBySelector      = "app.kubernetes.io/managed-by=azure-functions-controller"
+	functionNameLabel      = "azurefunctions.dev.azure.com/name"
+	functionNamespaceLabel = "azurefunctions.dev.azure.com/namespace"
+)
+
+type IstioComponent struct {
+	deploymentsLister appslisters.DeploymentLister
+	namespacesLister  corelisters.NamespaceLister
+}
 
 func (i *IstioComponent) Install() (components.Component, error) {
 	err := i.downloadAndExtractIstio()
@@ -20,8 +50,8 @@ func (i *IstioComponent) Install() (components.Component, error) {
 	crdDirPath := "istio-1.0.0/install/kubernetes/helm/istio/templates/crds.yaml"
 	istioPath := "istio-1.0.0/install/kubernetes/istio-demo.yaml"
 
-	utils.RunCMD("kubectl", []string{"apply", "-f", crdDirPath, "-n", "istio-system"})
-	utils.RunCMD("kubectl", []string{"apply", "-f", istioPath, "-n", "istio-system"})
+	utils.RunCMD("istio", "kubectl", []string{"apply", "-f", crdDirPath, "-n", "istio-system"})
+	utils.RunCMD("istio", "kubectl", []string{"apply", "-f", istioPath, "-n", "istio-system"})
 
 	return i, nil
 }
@@ -30,20 +60,123 @@ func (i *IstioComponent) Namespace() string {
 	return "istio-system"
 }
 
+// Informers watches the Deployments in the namespace of Istio, for the
+// pilot, and the namespaces functions may run in, for the injection label
+func (i *IstioComponent) Informers(client kubernetes.Interface) []cache.SharedIndexInformer {
+	istioInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(client, 0,
+		kubeinformers.WithNamespace(i.Namespace()))
+	i.deploymentsLister = istioInformerFactory.Apps().V1().Deployments().Lister()
+
+	namespaceInformerFactory := kubeinformers.NewSharedInformerFactory(client, 0)
+	i.namespacesLister = namespaceInformerFactory.Core().V1().Namespaces().Lister()
+
+	return []cache.SharedIndexInformer{
+		istioInformerFactory.Apps().V1().Deployments().Informer(),
+		namespaceInformerFactory.Core().V1().Namespaces().Informer(),
+	}
+}
+
 func (i *IstioComponent) IsRunning() (bool, error) {
+	if i.deploymentsLister == nil {
+		return false, fmt.Errorf("istio: deployments are not watched")
+	}
+
+	pilotDeployment, err := i.deploymentsLister.Deployments(i.Namespace()).Get("istio-pilot")
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return pilotDeployment.Status.AvailableReplicas > 0, nil
+}
+
+// PodAnnotations asks for a sidecar in every function pod
+func (i *IstioComponent) PodAnnotations() map[string]string {
+	return map[string]string{
+		injectAnnotation: "true",
+	}
+}
+
+// ReconcileFunction makes sure the sidecar injector handles the namespace the
+// function workload runs in. A namespace without the injection label is
+// labeled and marked as labeled by us. A namespace that already has it, with
+// whatever value, is left alone
+func (i *IstioComponent) ReconcileFunction(function *funcv1.AzureFunction, namespace string) error {
+	if i.namespacesLister == nil {
+		return fmt.Errorf("istio: namespaces are not watched")
+	}
+
+	// the namespace is read from the cache, so the API server is only called
+	// the first time a function runs in a namespace without the label
+	cached, err := i.namespacesLister.Get(namespace)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := cached.Labels[injectionLabel]; ok {
+		return nil
+	}
+
+	ns := cached.DeepCopy()
+	if ns.Labels == nil {
+		ns.Labels = map[string]string{}
+	}
+
+	if ns.Annotations == nil {
+		ns.Annotations = map[string]string{}
+	}
+
+	ns.Labels[injectionLabel] = "enabled"
+	ns.Annotations[labeledAnnotation] = "true"
+
+	_, err = utils.GetKubeClient().CoreV1().Namespaces().Update(ns)
+	return err
+}
+
+// DeleteFunctionResources removes the injection label from a namespace we
+// labeled once the last function in it is deleted. Functions are found by
+// the Deployments the controller created for them, by name and namespace,
+// since functions of different namespaces share a namespace with the same
+// name
+func (i *IstioComponent) DeleteFunctionResources(namespace string, functionNamespace string, name string) (bool, error) {
 	clientSet := utils.GetKubeClient()
-	namespace := i.Namespace()
 
-	pilotDeployment, err := clientSet.AppsV1().Deployments(namespace).Get("istio-pilot", metav1.GetOptions{})
+	ns, err := clientSet.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return true, nil
+	}
 	if err != nil {
 		return false, err
 	}
 
-	if pilotDeployment == nil {
-		return false, nil
+	if ns.Annotations[labeledAnnotation] != "true" {
+		return true, nil
+	}
+
+	deployments, err := clientSet.AppsV1().Deployments(namespace).List(metav1.ListOptions{
+		LabelSelector: managedBySelector,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	for _, deployment := range deployments.Items {
+		if deployment.Labels[functionNameLabel] != name || deployment.Labels[functionNamespaceLabel] != functionNamespace {
+			return true, nil
+		}
+	}
+
+	delete(ns.Labels, injectionLabel)
+	delete(ns.Annotations, labeledAnnotation)
+
+	_, err = clientSet.CoreV1().Namespaces().Update(ns)
+	if err != nil {
+		return false, err
 	}
 
-	return pilotDeployment.Status.AvailableReplicas == 1, nil
+	return true, nil
 }
 
 func (i IstioComponent) downloadAndExtractIstio() error {
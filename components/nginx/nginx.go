@@ -1,19 +1,26 @@
 package nginx
 
 import (
+	"errors"
 	"io/ioutil"
 	"strconv"
 
 	"github.com/yaron2/azfuncs/components"
 	"github.com/yaron2/azfuncs/utils"
 	"k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 )
 
 const nginxIngressMandatoryTemplate = "https://raw.githubusercontent.com/kubernetes/ingress-nginx/master/deploy/mandatory.yaml"
 const nginxIngressGenericTemplate = "https://raw.githubusercontent.com/kubernetes/ingress-nginx/master/deploy/provider/cloud-generic.yaml"
 
-type NginxIngressComponent struct{}
+type NginxIngressComponent struct {
+	podsLister corelisters.PodLister
+}
 
 func (n *NginxIngressComponent) Install() (components.Component, error) {
 	templates, err := n.getNginxTemplates()
@@ -35,7 +42,7 @@ func (n *NginxIngressComponent) Install() (components.Component, error) {
 			"./" + fileName,
 		}
 
-		utils.RunCMD("kubectl", args)
+		utils.RunCMD("nginx", "kubectl", args)
 	}
 
 	return n, nil
@@ -49,21 +56,41 @@ func (n *NginxIngressComponent) ServiceName() string {
 	return "ingress-nginx"
 }
 
+// Informers watches the pods in the namespace of the ingress controller
+func (n *NginxIngressComponent) Informers(client kubernetes.Interface) []cache.SharedIndexInformer {
+	informerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(client, 0,
+		kubeinformers.WithNamespace(n.Namespace()))
+	n.podsLister = informerFactory.Core().V1().Pods().Lister()
+
+	return []cache.SharedIndexInformer{informerFactory.Core().V1().Pods().Informer()}
+}
+
+// IsRunning reports whether any pod of the ingress controller is ready. The
+// namespace also holds pods that are not the controller, such as completed
+// admission jobs, so a single pod doesn't tell
 func (n *NginxIngressComponent) IsRunning() (bool, error) {
-	clientSet := utils.GetKubeClient()
-	namespace := n.Namespace()
+	if n.podsLister == nil {
+		return false, errors.New("nginx: pods are not watched")
+	}
 
-	pods, err := clientSet.CoreV1().Pods(namespace).List(metav1.ListOptions{})
+	pods, err := n.podsLister.Pods(n.Namespace()).List(labels.Everything())
 	if err != nil {
 		return false, err
 	}
 
-	if len(pods.Items) == 0 {
-		return false, nil
+	for _, pod := range pods {
+		if pod.Status.Phase != v1.PodRunning {
+			continue
+		}
+
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == v1.PodReady && condition.Status == v1.ConditionTrue {
+				return true, nil
+			}
+		}
 	}
 
-	controller := pods.Items[0]
-	return controller.Status.Phase == v1.PodRunning, nil
+	return false, nil
 }
 
 func (n *NginxIngressComponent) getNginxTemplates() ([]string, error) {
@@ -1,11 +1,50 @@
 package components
 
+import (
+	funcv1 "github.com/yaron2/azfuncs/pkg/apis/azurefunctions/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
 type Component interface {
 	Install() (Component, error)
 	Namespace() string
 	IsRunning() (bool, error)
 }
 
+// FinalizingComponent is implemented by components that create or change
+// resources on behalf of functions, such as the injection label Istio puts on
+// the namespaces functions run in
+type FinalizingComponent interface {
+	// DeleteFunctionResources deletes the resources created for the function
+	// and reports whether all of them are confirmed gone. The resources of
+	// the function are in namespace, which is only the namespace of the
+	// function itself when no shared namespace is used
+	DeleteFunctionResources(namespace string, functionNamespace string, name string) (bool, error)
+}
+
+// FunctionComponent is implemented by components that manage objects of
+// their own for every function, such as the injection label of Istio. It is
+// called on every reconcile and must be idempotent
+type FunctionComponent interface {
+	ReconcileFunction(function *funcv1.AzureFunction, namespace string) error
+}
+
+// PodComponent is implemented by components that need annotations on the
+// pods of every function, such as the sidecar injection annotation of a mesh
+type PodComponent interface {
+	PodAnnotations() map[string]string
+}
+
+// InformerComponent is implemented by components that read the state of the
+// cluster from informer caches instead of the API server, since they are
+// asked on every reconcile and readiness probe. Informers is called once,
+// before the controller starts the informers it returns and waits for them
+// to sync
+type InformerComponent interface {
+	Informers(client kubernetes.Interface) []cache.SharedIndexInformer
+}
+
 type IngressComponent interface {
 	ServiceName() string
 	Namespace() string
@@ -0,0 +1,345 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/util/homedir"
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the configuration of the controller. It is read from a YAML file,
+// with the defaults below for anything the file leaves out, and command-line
+// flags override the file
+type Config struct {
+	// Kubeconfig is used when the controller doesn't run in a cluster
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+
+	// Namespace is the namespace the controller runs in. It holds the leader
+	// election lease. Defaults to POD_NAMESPACE, or "azure-functions"
+	Namespace string `json:"namespace,omitempty"`
+
+	// Ingress and Mesh name the components to install and route functions
+	// through, such as "nginx" and "istio". Both are optional
+	Ingress string `json:"ingress,omitempty"`
+	Mesh    string `json:"mesh,omitempty"`
+
+	// SharedNamespace opts into creating the resources of every function in
+	// this one namespace instead of next to the function
+	SharedNamespace string `json:"sharedNamespace,omitempty"`
+
+	// ExternalBaseURL replaces the ingress controller address in the URL of
+	// routed functions. Reloadable
+	ExternalBaseURL string `json:"externalBaseURL,omitempty"`
+
+	// NodePortFallback reports a node address for services without a load
+	// balancer address. Reloadable
+	NodePortFallback bool `json:"nodePortFallback,omitempty"`
+
+	// Workers is the number of functions reconciled concurrently. Defaults to 4
+	Workers int `json:"workers,omitempty"`
+
+	// ResyncPeriod is how often every function is reconciled again. Defaults to 10m
+	ResyncPeriod metav1.Duration `json:"resyncPeriod,omitempty"`
+
+	// StallTimeout is how long workers may go without progress before the
+	// liveness probe fails. Defaults to 5m
+	StallTimeout metav1.Duration `json:"stallTimeout,omitempty"`
+
+	// MetricsAddr and HealthAddr are the listen addresses of the metrics and
+	// the health probe servers. Default to ":8080" and ":8081"
+	MetricsAddr string `json:"metricsAddr,omitempty"`
+	HealthAddr  string `json:"healthAddr,omitempty"`
+
+	Log            LogConfig            `json:"log,omitempty"`
+	LeaderElection LeaderElectionConfig `json:"leaderElection,omitempty"`
+	Webhook        WebhookConfig        `json:"webhook,omitempty"`
+	Workload       WorkloadConfig       `json:"workload,omitempty"`
+}
+
+// LogConfig sets the log output. Reloadable
+type LogConfig struct {
+	// Format is "logfmt" or "json". Defaults to "logfmt"
+	Format string `json:"format,omitempty"`
+
+	// Level is a logrus level such as "debug" or "info". Defaults to "info"
+	Level string `json:"level,omitempty"`
+}
+
+// LeaderElectionConfig controls how replicas of the controller agree on
+// which one of them reconciles functions
+type LeaderElectionConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+
+	// Identity of this replica. Defaults to POD_NAME, or the hostname
+	Identity string `json:"identity,omitempty"`
+
+	// Default to 15s, 10s and 2s
+	LeaseDuration metav1.Duration `json:"leaseDuration,omitempty"`
+	RenewDeadline metav1.Duration `json:"renewDeadline,omitempty"`
+	RetryPeriod   metav1.Duration `json:"retryPeriod,omitempty"`
+}
+
+// WebhookConfig enables the admission webhook when both files are set
+type WebhookConfig struct {
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+
+	// Port defaults to 8443
+	Port int `json:"port,omitempty"`
+}
+
+// Enabled reports whether the webhook should be served
+func (w WebhookConfig) Enabled() bool {
+	return w.CertFile != "" && w.KeyFile != ""
+}
+
+// WorkloadConfig holds the defaults for the resources created for every
+// function. Reloadable, changes apply as functions are reconciled
+type WorkloadConfig struct {
+	// TargetCPUUtilizationPercentage of the autoscaler. Defaults to 60
+	TargetCPUUtilizationPercentage int32 `json:"targetCPUUtilizationPercentage,omitempty"`
+
+	// NodeSelector, Affinity, Tolerations and TopologySpreadConstraints are
+	// the default scheduling profile of function pods. A function that sets
+	// one of them replaces the default of that field. All empty by default
+	NodeSelector              map[string]string                `json:"nodeSelector,omitempty"`
+	Affinity                  *apiv1.Affinity                  `json:"affinity,omitempty"`
+	Tolerations               []apiv1.Toleration               `json:"tolerations,omitempty"`
+	TopologySpreadConstraints []apiv1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+
+	// VirtualNodes identifies the nodes functions with the VirtualNodes burst
+	// policy overflow to
+	VirtualNodes VirtualNodesConfig `json:"virtualNodes,omitempty"`
+
+	// ImagePullSecret names a Secret in the namespace of the controller that
+	// is added to every function pod. It is copied into the namespaces the
+	// functions run in
+	ImagePullSecret string `json:"imagePullSecret,omitempty"`
+}
+
+// VirtualNodesConfig identifies virtual-kubelet nodes, such as the virtual
+// nodes of AKS backed by Azure Container Instances
+type VirtualNodesConfig struct {
+	// NodeSelector matches the labels of virtual nodes. Defaults to
+	// type: virtual-kubelet
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// Tolerations tolerate the taints of virtual nodes. Default to the
+	// virtual-kubelet.io/provider and azure.com/aci taints
+	Tolerations []apiv1.Toleration `json:"tolerations,omitempty"`
+}
+
+// Default returns the configuration used when no file or flag sets anything
+func Default() *Config {
+	config := &Config{
+		Kubeconfig:   defaultKubeconfig(),
+		Namespace:    os.Getenv("POD_NAMESPACE"),
+		Workers:      4,
+		ResyncPeriod: metav1.Duration{Duration: 10 * time.Minute},
+		StallTimeout: metav1.Duration{Duration: 5 * time.Minute},
+		MetricsAddr:  ":8080",
+		HealthAddr:   ":8081",
+		Log: LogConfig{
+			Format: "logfmt",
+			Level:  "info",
+		},
+		LeaderElection: LeaderElectionConfig{
+			Identity:      os.Getenv("POD_NAME"),
+			LeaseDuration: metav1.Duration{Duration: 15 * time.Second},
+			RenewDeadline: metav1.Duration{Duration: 10 * time.Second},
+			RetryPeriod:   metav1.Duration{Duration: 2 * time.Second},
+		},
+		Webhook: WebhookConfig{
+			Port: 8443,
+		},
+		Workload: WorkloadConfig{
+			TargetCPUUtilizationPercentage: 60,
+			VirtualNodes: VirtualNodesConfig{
+				NodeSelector: map[string]string{
+					"type": "virtual-kubelet",
+				},
+				Tolerations: []apiv1.Toleration{
+					{
+						Key:      "virtual-kubelet.io/provider",
+						Operator: apiv1.TolerationOpExists,
+						Effect:   apiv1.TaintEffectNoSchedule,
+					},
+					{
+						Key:      "azure.com/aci",
+						Operator: apiv1.TolerationOpExists,
+						Effect:   apiv1.TaintEffectNoSchedule,
+					},
+				},
+			},
+		},
+	}
+
+	if config.Namespace == "" {
+		config.Namespace = "azure-functions"
+	}
+
+	if config.LeaderElection.Identity == "" {
+		config.LeaderElection.Identity, _ = os.Hostname()
+	}
+
+	return config
+}
+
+func defaultKubeconfig() string {
+	if home := homedir.HomeDir(); home != "" {
+		return filepath.Join(home, ".kube", "config")
+	}
+
+	return ""
+}
+
+// LoadFile returns the defaults overlaid with the YAML file at path. An empty
+// path returns the defaults
+func LoadFile(path string) (*Config, error) {
+	config := Default()
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = yaml.UnmarshalStrict(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	return config, nil
+}
+
+// Validate checks the configuration for values the controller can't run with
+func (c *Config) Validate() error {
+	allErrs := field.ErrorList{}
+
+	if c.Namespace == "" {
+		allErrs = append(allErrs, field.Required(field.NewPath("namespace"), ""))
+	}
+
+	if c.Workers < 1 {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("workers"), c.Workers, "must be at least 1"))
+	}
+
+	for _, duration := range []struct {
+		path  *field.Path
+		value time.Duration
+	}{
+		{field.NewPath("resyncPeriod"), c.ResyncPeriod.Duration},
+		{field.NewPath("stallTimeout"), c.StallTimeout.Duration},
+		{field.NewPath("leaderElection", "leaseDuration"), c.LeaderElection.LeaseDuration.Duration},
+		{field.NewPath("leaderElection", "renewDeadline"), c.LeaderElection.RenewDeadline.Duration},
+		{field.NewPath("leaderElection", "retryPeriod"), c.LeaderElection.RetryPeriod.Duration},
+	} {
+		if duration.value <= 0 {
+			allErrs = append(allErrs, field.Invalid(duration.path, duration.value.String(), "must be positive"))
+		}
+	}
+
+	if c.LeaderElection.Enabled && c.LeaderElection.RenewDeadline.Duration >= c.LeaderElection.LeaseDuration.Duration {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("leaderElection", "renewDeadline"), c.LeaderElection.RenewDeadline.Duration.String(), "must be less than leaseDuration"))
+	}
+
+	switch strings.ToLower(c.Log.Format) {
+	case "logfmt", "json":
+	default:
+		allErrs = append(allErrs, field.NotSupported(field.NewPath("log", "format"), c.Log.Format, []string{"logfmt", "json"}))
+	}
+
+	if (c.Webhook.CertFile == "") != (c.Webhook.KeyFile == "") {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("webhook"), "", "certFile and keyFile must be set together"))
+	}
+
+	if c.Webhook.Port < 1 || c.Webhook.Port > 65535 {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("webhook", "port"), c.Webhook.Port, "must be a valid port"))
+	}
+
+	target := c.Workload.TargetCPUUtilizationPercentage
+	if target < 1 || target > 100 {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("workload", "targetCPUUtilizationPercentage"), target, "must be between 1 and 100"))
+	}
+
+	if len(c.Workload.VirtualNodes.NodeSelector) == 0 {
+		allErrs = append(allErrs, field.Required(field.NewPath("workload", "virtualNodes", "nodeSelector"), "virtual nodes must be told apart from real nodes"))
+	}
+
+	return allErrs.ToAggregate()
+}
+
+// RestartRequired lists the settings that differ between c and updated but
+// only take effect when the controller starts. The log, workload,
+// externalBaseURL and nodePortFallback settings are applied on reload
+func (c *Config) RestartRequired(updated *Config) []string {
+	changed := []string{}
+
+	for name, differs := range map[string]bool{
+		"kubeconfig":      updated.Kubeconfig != c.Kubeconfig,
+		"namespace":       updated.Namespace != c.Namespace,
+		"ingress":         updated.Ingress != c.Ingress,
+		"mesh":            updated.Mesh != c.Mesh,
+		"sharedNamespace": updated.SharedNamespace != c.SharedNamespace,
+		"workers":         updated.Workers != c.Workers,
+		"resyncPeriod":    updated.ResyncPeriod != c.ResyncPeriod,
+		"stallTimeout":    updated.StallTimeout != c.StallTimeout,
+		"metricsAddr":     updated.MetricsAddr != c.MetricsAddr,
+		"healthAddr":      updated.HealthAddr != c.HealthAddr,
+		"leaderElection":  updated.LeaderElection != c.LeaderElection,
+		"webhook":         updated.Webhook != c.Webhook,
+	} {
+		if differs {
+			changed = append(changed, name)
+		}
+	}
+
+	sort.Strings(changed)
+	return changed
+}
+
+// Reload returns a copy of c with the reloadable settings taken from updated
+func (c *Config) Reload(updated *Config) *Config {
+	reloaded := *c
+	reloaded.ExternalBaseURL = updated.ExternalBaseURL
+	reloaded.NodePortFallback = updated.NodePortFallback
+	reloaded.Log = updated.Log
+	reloaded.Workload = updated.Workload
+
+	return &reloaded
+}
+
+// Store holds the current configuration, so settings can be reloaded while
+// workers are reading them
+type Store struct {
+	value atomic.Value
+}
+
+// NewStore returns a store holding config
+func NewStore(config *Config) *Store {
+	store := &Store{}
+	store.Set(config)
+	return store
+}
+
+// Get returns the current configuration. It must not be modified
+func (s *Store) Get() *Config {
+	return s.value.Load().(*Config)
+}
+
+// Set replaces the current configuration
+func (s *Store) Set(config *Config) {
+	s.value.Store(config)
+}
@@ -0,0 +1,139 @@
+package config
+
+import (
+	"flag"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Flags holds the command-line flags. Only the flags given on the command
+// line override the configuration file
+type Flags struct {
+	ConfigFile string
+
+	fs        *flag.FlagSet
+	values    Config
+	targetCPU int
+}
+
+// flagSetters copy the value of a flag onto a configuration
+var flagSetters = map[string]func(dst *Config, src *Config){
+	"kubeconfig":        func(dst *Config, src *Config) { dst.Kubeconfig = src.Kubeconfig },
+	"namespace":         func(dst *Config, src *Config) { dst.Namespace = src.Namespace },
+	"ingress":           func(dst *Config, src *Config) { dst.Ingress = src.Ingress },
+	"mesh":              func(dst *Config, src *Config) { dst.Mesh = src.Mesh },
+	"shared-namespace":  func(dst *Config, src *Config) { dst.SharedNamespace = src.SharedNamespace },
+	"external-base-url": func(dst *Config, src *Config) { dst.ExternalBaseURL = src.ExternalBaseURL },
+	"nodeport-fallback": func(dst *Config, src *Config) { dst.NodePortFallback = src.NodePortFallback },
+	"workers":           func(dst *Config, src *Config) { dst.Workers = src.Workers },
+	"resync-period":     func(dst *Config, src *Config) { dst.ResyncPeriod = src.ResyncPeriod },
+	"stall-timeout":     func(dst *Config, src *Config) { dst.StallTimeout = src.StallTimeout },
+	"metrics-addr":      func(dst *Config, src *Config) { dst.MetricsAddr = src.MetricsAddr },
+	"health-addr":       func(dst *Config, src *Config) { dst.HealthAddr = src.HealthAddr },
+	"log-format":        func(dst *Config, src *Config) { dst.Log.Format = src.Log.Format },
+	"log-level":         func(dst *Config, src *Config) { dst.Log.Level = src.Log.Level },
+	"leader-elect":      func(dst *Config, src *Config) { dst.LeaderElection.Enabled = src.LeaderElection.Enabled },
+	"leader-elect-id":   func(dst *Config, src *Config) { dst.LeaderElection.Identity = src.LeaderElection.Identity },
+	"webhook-cert-file": func(dst *Config, src *Config) { dst.Webhook.CertFile = src.Webhook.CertFile },
+	"webhook-key-file":  func(dst *Config, src *Config) { dst.Webhook.KeyFile = src.Webhook.KeyFile },
+	"webhook-port":      func(dst *Config, src *Config) { dst.Webhook.Port = src.Webhook.Port },
+	"image-pull-secret": func(dst *Config, src *Config) { dst.Workload.ImagePullSecret = src.Workload.ImagePullSecret },
+	"target-cpu-percent": func(dst *Config, src *Config) {
+		dst.Workload.TargetCPUUtilizationPercentage = src.Workload.TargetCPUUtilizationPercentage
+	},
+}
+
+// deprecatedEnv are the environment variables that configured the controller
+// before the configuration file. They are only used for the settings that
+// neither the file nor a flag sets
+var deprecatedEnv = []struct {
+	name    string
+	flag    string
+	setting string
+	get     func(c *Config) *string
+}{
+	{name: "INGRESS", flag: "ingress", setting: "ingress", get: func(c *Config) *string { return &c.Ingress }},
+	{name: "MESH", flag: "mesh", setting: "mesh", get: func(c *Config) *string { return &c.Mesh }},
+}
+
+// BindFlags registers the flags on fs. The defaults shown in the usage are
+// the defaults of the configuration
+func BindFlags(fs *flag.FlagSet) *Flags {
+	defaults := Default()
+	f := &Flags{fs: fs}
+	v := &f.values
+
+	fs.StringVar(&f.ConfigFile, "config", "", "path to the YAML configuration file")
+	fs.StringVar(&v.Kubeconfig, "kubeconfig", defaults.Kubeconfig, "path to a kubeconfig, used when not running in a cluster")
+	fs.StringVar(&v.Namespace, "namespace", defaults.Namespace, "namespace the controller runs in")
+	fs.StringVar(&v.Ingress, "ingress", defaults.Ingress, "ingress component to install and route functions through, such as nginx")
+	fs.StringVar(&v.Mesh, "mesh", defaults.Mesh, "service mesh component to install, such as istio")
+	fs.StringVar(&v.SharedNamespace, "shared-namespace", defaults.SharedNamespace, "create the resources of all functions in this namespace")
+	fs.StringVar(&v.ExternalBaseURL, "external-base-url", defaults.ExternalBaseURL, "base URL of routed functions, instead of the ingress address")
+	fs.BoolVar(&v.NodePortFallback, "nodeport-fallback", defaults.NodePortFallback, "report a node address for services without a load balancer address")
+	fs.IntVar(&v.Workers, "workers", defaults.Workers, "number of functions reconciled concurrently")
+	fs.DurationVar(&v.ResyncPeriod.Duration, "resync-period", defaults.ResyncPeriod.Duration, "how often all functions are reconciled again")
+	fs.DurationVar(&v.StallTimeout.Duration, "stall-timeout", defaults.StallTimeout.Duration, "how long workers may make no progress before the liveness probe fails")
+	fs.StringVar(&v.MetricsAddr, "metrics-addr", defaults.MetricsAddr, "address to serve metrics on")
+	fs.StringVar(&v.HealthAddr, "health-addr", defaults.HealthAddr, "address to serve health probes and the log level on")
+	fs.StringVar(&v.Log.Format, "log-format", defaults.Log.Format, "log format, logfmt or json")
+	fs.StringVar(&v.Log.Level, "log-level", defaults.Log.Level, "log level, such as debug, info or warning")
+	fs.BoolVar(&v.LeaderElection.Enabled, "leader-elect", defaults.LeaderElection.Enabled, "only reconcile functions while holding the leader lease")
+	fs.StringVar(&v.LeaderElection.Identity, "leader-elect-id", defaults.LeaderElection.Identity, "identity of this replica in leader election")
+	fs.StringVar(&v.Webhook.CertFile, "webhook-cert-file", defaults.Webhook.CertFile, "TLS certificate of the admission webhook")
+	fs.StringVar(&v.Webhook.KeyFile, "webhook-key-file", defaults.Webhook.KeyFile, "TLS key of the admission webhook")
+	fs.IntVar(&v.Webhook.Port, "webhook-port", defaults.Webhook.Port, "port of the admission webhook")
+	fs.StringVar(&v.Workload.ImagePullSecret, "image-pull-secret", defaults.Workload.ImagePullSecret, "secret in the controller namespace used to pull the images of all functions")
+	fs.IntVar(&f.targetCPU, "target-cpu-percent", int(defaults.Workload.TargetCPUUtilizationPercentage), "default target CPU utilization of function autoscalers")
+
+	return f
+}
+
+// Load reads the configuration file and applies the flags that were set on
+// the command line. It is called again to reload the configuration
+func (f *Flags) Load() (*Config, error) {
+	config, err := LoadFile(f.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	f.values.Workload.TargetCPUUtilizationPercentage = int32(f.targetCPU)
+
+	visited := map[string]bool{}
+	f.fs.Visit(func(fl *flag.Flag) {
+		visited[fl.Name] = true
+		if setter, ok := flagSetters[fl.Name]; ok {
+			setter(config, &f.values)
+		}
+	})
+
+	applyDeprecatedEnv(config, visited)
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// applyDeprecatedEnv sets the settings of deprecatedEnv that are still unset
+// from their environment variable, and warns that the variable is deprecated
+func applyDeprecatedEnv(config *Config, visited map[string]bool) {
+	for _, env := range deprecatedEnv {
+		value, ok := os.LookupEnv(env.name)
+		if !ok {
+			continue
+		}
+
+		setting := env.get(config)
+		if visited[env.flag] || *setting != "" {
+			log.Warnf("The %s environment variable is deprecated and ignored, since %s is set by the configuration file or -%s", env.name, env.setting, env.flag)
+			continue
+		}
+
+		log.Warnf("The %s environment variable is deprecated, set %s in the configuration file or -%s instead", env.name, env.setting, env.flag)
+		*setting = value
+	}
+}
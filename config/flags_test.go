@@ -0,0 +1,100 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// TestLoadDeprecatedEnv checks that INGRESS and MESH are only used for the
+// settings neither the configuration file nor a flag sets
+func TestLoadDeprecatedEnv(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		env     map[string]string
+		file    string
+		args    []string
+		ingress string
+		mesh    string
+	}{
+		{
+			name: "nothing set",
+		},
+		{
+			name:    "env only",
+			env:     map[string]string{"INGRESS": "nginx", "MESH": "ISTIO"},
+			ingress: "nginx",
+			mesh:    "ISTIO",
+		},
+		{
+			name:    "file over env",
+			env:     map[string]string{"INGRESS": "nginx", "MESH": "ISTIO"},
+			file:    "ingress: traefik\n",
+			ingress: "traefik",
+			mesh:    "ISTIO",
+		},
+		{
+			name:    "flag over env and file",
+			env:     map[string]string{"INGRESS": "nginx"},
+			file:    "ingress: traefik\n",
+			args:    []string{"-ingress=contour"},
+			ingress: "contour",
+		},
+		{
+			name: "empty flag disables",
+			env:  map[string]string{"INGRESS": "nginx"},
+			args: []string{"-ingress="},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{"INGRESS", "MESH"} {
+				previous, ok := os.LookupEnv(name)
+				os.Unsetenv(name)
+
+				defer func(name string) {
+					if ok {
+						os.Setenv(name, previous)
+					} else {
+						os.Unsetenv(name)
+					}
+				}(name)
+			}
+
+			for name, value := range test.env {
+				os.Setenv(name, value)
+			}
+
+			args := test.args
+			if test.file != "" {
+				file, err := ioutil.TempFile("", "config")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.Remove(file.Name())
+
+				if _, err := file.WriteString(test.file); err != nil {
+					t.Fatal(err)
+				}
+				file.Close()
+
+				args = append([]string{"-config=" + file.Name()}, args...)
+			}
+
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			flags := BindFlags(fs)
+			if err := fs.Parse(args); err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := flags.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if config.Ingress != test.ingress || config.Mesh != test.mesh {
+				t.Errorf("expected ingress %q and mesh %q, got %q and %q", test.ingress, test.mesh, config.Ingress, config.Mesh)
+			}
+		})
+	}
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/yaron2/azfuncs/logging"
+	"github.com/yaron2/azfuncs/metrics"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/uuid"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
@@ -21,10 +26,21 @@ type Controller struct {
 	queue     workqueue.RateLimitingInterface
 	informer  cache.SharedIndexInformer
 	handler   Handler
+	workers   int
+
+	// cacheSyncs are the secondary informers that have to be synced
+	// before any function is reconciled
+	cacheSyncs []cache.InformerSynced
+
+	// busyWorkers and lastProgress are updated atomically by the workers
+	// and let the liveness probe detect workers that stopped making progress
+	busyWorkers  int32
+	lastProgress int64
 }
 
-// Run is the main path of execution for the controller loop
-func (c *Controller) Run(stopCh <-chan struct{}) {
+// Run is the main path of execution for the controller loop. The informer
+// is started separately, so replicas that aren't leading keep a warm cache
+func (c *Controller) Run(ctx context.Context) {
 	// handle a panic with logging and exiting
 	defer utilruntime.HandleCrash()
 	// ignore new items in the queue but when all goroutines
@@ -33,45 +49,86 @@ func (c *Controller) Run(stopCh <-chan struct{}) {
 
 	c.logger.Info("Controller.Run: initiating")
 
-	// run the informer to start listing and watching resources
-	go c.informer.Run(stopCh)
-
 	// do the initial synchronization (one time) to populate resources
-	if !cache.WaitForCacheSync(stopCh, c.HasSynced) {
+	if !cache.WaitForCacheSync(ctx.Done(), c.HasSynced) {
 		utilruntime.HandleError(fmt.Errorf("Error syncing cache"))
 		return
 	}
 	c.logger.Info("Controller.Run: cache sync complete")
 
-	// run the runWorker method every second with a stop channel
-	wait.Until(c.runWorker, time.Second, stopCh)
+	workers := c.workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	metrics.Workers.Set(float64(workers))
+	c.recordProgress()
+	c.logger.Infof("Controller.Run: starting %d workers", workers)
+
+	// run the runWorker method every second on each worker until the context
+	// is cancelled, which also cancels in-flight reconciles. The queue hands
+	// a key to one worker at a time, so a function is never reconciled by
+	// two workers concurrently
+	for i := 0; i < workers; i++ {
+		go wait.Until(func() { c.runWorker(ctx) }, time.Second, ctx.Done())
+	}
+
+	<-ctx.Done()
 }
 
 // HasSynced allows us to satisfy the Controller interface
 // by wiring up the informer's HasSynced method to it
 func (c *Controller) HasSynced() bool {
-	return c.informer.HasSynced()
+	if !c.informer.HasSynced() {
+		return false
+	}
+
+	for _, synced := range c.cacheSyncs {
+		if !synced() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Stalled reports whether there is work to do, either queued or in flight,
+// but no worker has picked up or finished a key for longer than timeout.
+// A replica whose workers haven't started, such as a standby, never stalls
+func (c *Controller) Stalled(timeout time.Duration) bool {
+	lastProgress := atomic.LoadInt64(&c.lastProgress)
+	if lastProgress == 0 {
+		return false
+	}
+
+	if c.queue.Len() == 0 && atomic.LoadInt32(&c.busyWorkers) == 0 {
+		return false
+	}
+
+	return time.Since(time.Unix(0, lastProgress)) > timeout
+}
+
+func (c *Controller) recordProgress() {
+	atomic.StoreInt64(&c.lastProgress, time.Now().UnixNano())
 }
 
 // runWorker executes the loop to process new items added to the queue
-func (c *Controller) runWorker() {
-	log.Info("Controller.runWorker: starting")
+func (c *Controller) runWorker(ctx context.Context) {
+	c.logger.Debug("Controller.runWorker: starting")
 
 	// invoke processNextItem to fetch and consume the next change
 	// to a watched or listed resource
-	for c.processNextItem() {
-		log.Info("Controller.runWorker: processing next item")
+	for c.processNextItem(ctx) {
+		c.logger.Debug("Controller.runWorker: processing next item")
 	}
 
-	log.Info("Controller.runWorker: completed")
+	c.logger.Debug("Controller.runWorker: completed")
 }
 
-// processNextItem retrieves each queued item and takes the
-// necessary handler action based off of if the item was
-// created or deleted
-func (c *Controller) processNextItem() bool {
-	log.Info("Controller.processNextItem: start")
-
+// processNextItem retrieves each queued key and hands it to the handler's
+// Reconcile method, which converges the function on its desired state
+// regardless of whether it was created, updated or deleted
+func (c *Controller) processNextItem(ctx context.Context) bool {
 	// fetch the next item (blocking) from the queue to process or
 	// if a shutdown is requested then return out of this to stop
 	// processing
@@ -86,45 +143,61 @@ func (c *Controller) processNextItem() bool {
 
 	defer c.queue.Done(key)
 
+	metrics.WorkersBusy.Inc()
+	defer metrics.WorkersBusy.Dec()
+
+	c.recordProgress()
+	atomic.AddInt32(&c.busyWorkers, 1)
+	defer func() {
+		atomic.AddInt32(&c.busyWorkers, -1)
+		c.recordProgress()
+	}()
+
 	// assert the string out of the key (format `namespace/name`)
 	keyRaw := key.(string)
 
-	// take the string key and get the object out of the indexer
-	//
-	// item will contain the complex object for the resource and
-	// exists is a bool that'll indicate whether or not the
-	// resource was created (true) or deleted (false)
-	//
-	// if there is an error in getting the key from the index
-	// then we want to retry this particular queue key a certain
-	// number of times (5 here) before we forget the queue key
-	// and throw an error
-	item, exists, err := c.informer.GetIndexer().GetByKey(keyRaw)
+	// every line logged while reconciling the key carries the function and
+	// an ID telling this reconcile apart from earlier ones of the same key
+	logger := c.logger.WithField(logging.FieldReconcileID, string(uuid.NewUUID()))
+	namespace, name, splitErr := cache.SplitMetaNamespaceKey(keyRaw)
+	if splitErr == nil {
+		logger = logger.WithFields(log.Fields{
+			logging.FieldNamespace: namespace,
+			logging.FieldName:      name,
+		})
+	}
+
+	start := time.Now()
+	result, err := c.handler.Reconcile(logging.WithLogger(ctx, logger), keyRaw)
+
+	outcome := metrics.OutcomeSuccess
 	if err != nil {
-		if c.queue.NumRequeues(key) < 5 {
-			c.logger.Errorf("Controller.processNextItem: Failed processing item with key %s with error %v, retrying", key, err)
-			c.queue.AddRateLimited(key)
-		} else {
-			c.logger.Errorf("Controller.processNextItem: Failed processing item with key %s with error %v, no more retries", key, err)
-			c.queue.Forget(key)
-			utilruntime.HandleError(err)
-		}
+		outcome = metrics.OutcomeError
+	} else if result.RequeueAfter > 0 {
+		outcome = metrics.OutcomeRequeue
 	}
 
-	// if the item doesn't exist then it was deleted and we need to fire off the handler's
-	// ObjectDeleted method. but if the object does exist that indicates that the object
-	// was created (or updated) so run the ObjectCreated method
+	metrics.Reconciles.WithLabelValues(outcome).Inc()
+	metrics.ReconcileDuration.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+
+	// if reconciling failed, the key goes back on the queue with an
+	// exponential backoff. Reconcile is idempotent, so a retry picks up
+	// wherever the previous attempt stopped
 	//
-	// after both instances, we want to forget the key from the queue, as this indicates
-	// a code path of successful queue key processing
-	if !exists {
-		c.logger.Infof("Controller.processNextItem: object deleted detected: %s", keyRaw)
-		c.handler.ObjectDeleted(keyRaw)
-		c.queue.Forget(key)
+	// a successful reconcile forgets the key's backoff history, but may
+	// still ask to be looked at again after a delay, for example while
+	// waiting on a load balancer address
+	if err != nil {
+		logger.Errorf("Controller.processNextItem: failed reconciling, retrying: %v", err)
+		c.queue.AddRateLimited(key)
+		utilruntime.HandleError(err)
 	} else {
-		c.logger.Infof("Controller.processNextItem: object created detected: %s", keyRaw)
-		c.handler.ObjectCreated(item)
+		logger.WithField("duration", time.Since(start).String()).Info("Controller.processNextItem: reconciled")
 		c.queue.Forget(key)
+
+		if result.RequeueAfter > 0 {
+			c.queue.AddAfter(key, result.RequeueAfter)
+		}
 	}
 
 	// keep the worker loop running by returning true
@@ -0,0 +1,122 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	funcv1 "github.com/yaron2/azfuncs/pkg/apis/azurefunctions/v1"
+	azurefunctionsscheme "github.com/yaron2/azfuncs/pkg/client/clientset/versioned/scheme"
+	apiv1 "k8s.io/api/core/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const eventSourceComponent = "azure-functions-controller"
+
+// Reasons of the Events recorded on AzureFunction objects, so that
+// `kubectl describe azfunc` tells what the controller did with a function
+const (
+	reasonCreated            = "Created"
+	reasonScaled             = "Scaled"
+	reasonRouted             = "Routed"
+	reasonURLAssigned        = "URLAssigned"
+	reasonConfigFailed       = "ConfigFailed"
+	reasonDeploymentFailed   = "DeploymentFailed"
+	reasonAutoscalerFailed   = "AutoscalerFailed"
+	reasonServiceFailed      = "ServiceFailed"
+	reasonIngressFailed      = "IngressFailed"
+	reasonIngressUnavailable = "IngressUnavailable"
+	reasonComponentFailed    = "ComponentFailed"
+	reasonURLFailed          = "URLFailed"
+	reasonFinalizerFailed    = "FinalizerFailed"
+	reasonStatusUpdateFailed = "StatusUpdateFailed"
+	reasonCleanupFailed      = "CleanupFailed"
+	reasonPullSecretFailed   = "PullSecretFailed"
+	reasonImagePullFailed    = "ImagePullFailed"
+	reasonPodTemplateFailed  = "PodTemplateFailed"
+	reasonRouteConflict      = "RouteConflict"
+	reasonInvalidRoute       = "InvalidRoute"
+)
+
+// newEventRecorder returns a recorder that writes Events through client. The
+// AzureFunction types are added to the client-go scheme so the recorder can
+// build references to them
+func newEventRecorder(client kubernetes.Interface) record.EventRecorder {
+	utilruntime.Must(azurefunctionsscheme.AddToScheme(scheme.Scheme))
+
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(log.Infof)
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+
+	return eventBroadcaster.NewRecorder(scheme.Scheme, apiv1.EventSource{Component: eventSourceComponent})
+}
+
+// recordEvent attaches an Event to the function. The handler may run without
+// a recorder, in which case events are dropped
+func (t *AzureFunctionsHandler) recordEvent(function *funcv1.AzureFunction, eventType string, reason string, message string) {
+	if t.Recorder == nil {
+		return
+	}
+
+	t.Recorder.Event(function, eventType, reason, message)
+}
+
+// recordWarning attaches a Warning Event for a failed step and passes the
+// error through, so failures can be recorded where they are returned
+func (t *AzureFunctionsHandler) recordWarning(function *funcv1.AzureFunction, reason string, err error) error {
+	t.recordEvent(function, apiv1.EventTypeWarning, reason, err.Error())
+	return err
+}
+
+// recordTransitions attaches Normal Events for the changes between the last
+// written status and the new one, so repeated reconciles of an unchanged
+// function don't record anything
+func (t *AzureFunctionsHandler) recordTransitions(previous *funcv1.AzureFunctionStatus, function *funcv1.AzureFunction) {
+	transitions := []struct {
+		conditionType funcv1.AzureFunctionConditionType
+		reason        string
+	}{
+		{funcv1.FunctionScaled, reasonScaled},
+		{funcv1.FunctionRouted, reasonRouted},
+	}
+
+	for _, transition := range transitions {
+		condition := function.Status.GetCondition(transition.conditionType)
+		if condition == nil || condition.Status != apiv1.ConditionTrue {
+			continue
+		}
+
+		old := previous.GetCondition(transition.conditionType)
+		if old != nil && old.Status == condition.Status && old.Message == condition.Message {
+			continue
+		}
+
+		t.recordEvent(function, apiv1.EventTypeNormal, transition.reason, condition.Message)
+	}
+
+	// an ingress component going down, a route claimed by another function
+	// or a route that can't be rendered doesn't fail the reconcile, but
+	// leaves routed functions unreachable through their routes
+	routed := function.Status.GetCondition(funcv1.FunctionRouted)
+	if routed != nil && (routed.Reason == reasonIngressUnavailable || routed.Reason == reasonRouteConflict || routed.Reason == reasonInvalidRoute) {
+		old := previous.GetCondition(funcv1.FunctionRouted)
+		if old == nil || old.Reason != routed.Reason || old.Message != routed.Message {
+			t.recordEvent(function, apiv1.EventTypeWarning, routed.Reason, routed.Message)
+		}
+	}
+
+	// pull failures are reported by the kubelet on the pods, repeat them on
+	// the function once rather than for every retry of the pull
+	pulled := function.Status.GetCondition(funcv1.FunctionImagePulled)
+	if pulled != nil && pulled.Status == apiv1.ConditionFalse {
+		old := previous.GetCondition(funcv1.FunctionImagePulled)
+		if old == nil || old.Status != pulled.Status {
+			t.recordEvent(function, apiv1.EventTypeWarning, reasonImagePullFailed, pulled.Reason+": "+pulled.Message)
+		}
+	}
+
+	if function.Status.URL != "" && function.Status.URL != previous.URL {
+		t.recordEvent(function, apiv1.EventTypeNormal, reasonURLAssigned, "Function is reachable at "+function.Status.URL)
+	}
+}
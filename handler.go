@@ -1,33 +1,46 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"strconv"
 	"strings"
 	"time"
 
-	"k8s.io/apimachinery/pkg/util/intstr"
-
 	log "github.com/Sirupsen/logrus"
 	"github.com/yaron2/azfuncs/components"
 	"github.com/yaron2/azfuncs/components/istio"
 	"github.com/yaron2/azfuncs/components/nginx"
+	"github.com/yaron2/azfuncs/config"
+	"github.com/yaron2/azfuncs/logging"
+	"github.com/yaron2/azfuncs/metrics"
 	funcv1 "github.com/yaron2/azfuncs/pkg/apis/azurefunctions/v1"
 	azurefunctions "github.com/yaron2/azfuncs/pkg/client/clientset/versioned"
+	listers "github.com/yaron2/azfuncs/pkg/client/listers/azurefunctions/v1"
 	"github.com/yaron2/azfuncs/utils"
-	appsv1 "k8s.io/api/apps/v1"
-	autoscalerv1 "k8s.io/api/autoscaling/v1"
-	"k8s.io/api/core/v1"
 	apiv1 "k8s.io/api/core/v1"
 	"k8s.io/api/extensions/v1beta1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	autoscalinglisters "k8s.io/client-go/listers/autoscaling/v2beta2"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	extensionslisters "k8s.io/client-go/listers/extensions/v1beta1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 )
 
 type Handler interface {
 	Init() error
-	ObjectCreated(obj interface{})
-	ObjectDeleted(obj interface{})
+	Reconcile(ctx context.Context, key string) (Result, error)
+}
+
+// Result tells the controller when a successfully reconciled key has to be
+// processed again, for state that converges outside of our control
+type Result struct {
+	RequeueAfter time.Duration
 }
 
 type AzureFunctionsHandler struct {
@@ -36,18 +49,64 @@ type AzureFunctionsHandler struct {
 	IngressComponent components.Component
 	MeshComponent    components.Component
 	FunctionsClient  azurefunctions.Interface
+	FunctionsLister  listers.AzureFunctionLister
+
+	// FunctionsIndexer is the index of the function informer, used to find
+	// the functions that claim a route through RoutesIndex
+	FunctionsIndexer cache.Indexer
+
+	// the listers read resources created by the controller from the informer
+	// caches, instead of issuing a GET for each of them on every reconcile
+	DeploymentsLister appslisters.DeploymentLister
+	AutoscalersLister autoscalinglisters.HorizontalPodAutoscalerLister
+	ServicesLister    corelisters.ServiceLister
+	IngressesLister   extensionslisters.IngressLister
+
+	// PodsLister reads the pods of functions, to tell why a function has no
+	// ready replica
+	PodsLister corelisters.PodLister
+
+	// ConfigMapsLister and SecretsLister read the ConfigMaps and Secrets
+	// functions take their settings from, to hash them into the pod template
+	ConfigMapsLister corelisters.ConfigMapLister
+	SecretsLister    corelisters.SecretLister
+
+	// IngressServiceLister reads the service of the ingress controller, which
+	// isn't created by us and so isn't in the cache of ServicesLister
+	IngressServiceLister corelisters.ServiceLister
+
+	// NodesLister reads the addresses of nodes, for functions reachable
+	// through a node port when their load balancer has no address
+	NodesLister corelisters.NodeLister
+
+	// ControllerSecretsLister reads the Secrets of the namespace of the
+	// controller, where the default image pull secret is copied from
+	ControllerSecretsLister corelisters.SecretLister
+
+	// SharedNamespace opts into the legacy layout where the child resources
+	// of every function are created in one namespace. When empty, they are
+	// created next to the function and owned by it
+	SharedNamespace string
+
+	// Config holds the settings that can be reloaded while functions are
+	// being reconciled, such as the workload defaults and the URL settings
+	Config *config.Store
+
+	// Recorder attaches Events to functions, so their history shows up in
+	// `kubectl describe` instead of only in the controller logs
+	Recorder record.EventRecorder
 }
 
-var clientSet kubernetes.Clientset
+var clientSet kubernetes.Interface
 
-const azureFunctionsNamespace = "azure-functions"
+// functionFinalizer keeps an AzureFunction around until the controller has
+// confirmed that every resource created for it is gone
+const functionFinalizer = "azurefunctions.dev.azure.com/cleanup"
 
 func (t *AzureFunctionsHandler) Init() error {
 	log.Info("AzureFunctionsHandler.Init")
 
-	t.registerComponents()
-
-	clientSet = *utils.GetKubeClient()
+	clientSet = utils.GetKubeClient()
 
 	err := t.installIngressIfRequested()
 	if err != nil {
@@ -59,26 +118,30 @@ func (t *AzureFunctionsHandler) Init() error {
 		return err
 	}
 
-	err = t.createFunctionsNamespace()
-	if err != nil {
-		fmt.Println("Warning: can't create namespace - " + err.Error())
+	if t.SharedNamespace != "" {
+		err = t.createFunctionsNamespace()
+		if err != nil {
+			log.WithField(logging.FieldNamespace, t.SharedNamespace).Warnf("AzureFunctionsHandler.Init: can't create namespace: %v", err)
+		}
 	}
 
 	return nil
 }
 
-func (t *AzureFunctionsHandler) registerComponents() {
+// RegisterComponents makes the ingress and mesh components available by
+// name. It must be called once, before Init or any event handler runs
+func (t *AzureFunctionsHandler) RegisterComponents() {
 	components.Register("nginx", &nginx.NginxIngressComponent{})
 	components.Register("istio", &istio.IstioComponent{})
 }
 
 func (t *AzureFunctionsHandler) createFunctionsNamespace() error {
-	ns := v1.Namespace{}
+	ns := apiv1.Namespace{}
 	ns.ObjectMeta = metav1.ObjectMeta{
-		Name: azureFunctionsNamespace,
+		Name: t.SharedNamespace,
 	}
 
-	_, err := clientSet.Core().Namespaces().Create(&ns)
+	_, err := clientSet.CoreV1().Namespaces().Create(&ns)
 	if err != nil {
 		return err
 	}
@@ -105,17 +168,19 @@ func (t *AzureFunctionsHandler) installComponent(name string) (components.Compon
 		return nil, err
 	}
 
+	logger := log.WithField(logging.FieldComponent, name)
+
 	isRunning, _ := component.IsRunning()
 	if !isRunning {
-		fmt.Println("Installing component " + name + " to namespace " + component.Namespace())
+		logger.Infof("AzureFunctionsHandler.installComponent: installing to namespace %s", component.Namespace())
 
 		component, err = component.Install()
 		if err != nil {
-			fmt.Println("Error installing component " + name + ": " + err.Error())
+			logger.Errorf("AzureFunctionsHandler.installComponent: %v", err)
 			return nil, err
 		}
 
-		fmt.Println("Component installation successful - " + name)
+		logger.Info("AzureFunctionsHandler.installComponent: installed")
 	}
 
 	return component, nil
@@ -134,319 +199,540 @@ func (t *AzureFunctionsHandler) installIngressIfRequested() error {
 	return nil
 }
 
-func (t *AzureFunctionsHandler) ObjectCreated(obj interface{}) {
-	log.Info("AzureFunctionsHandler.ObjectCreated")
+// Reconcile converges the resources of the function identified by key on
+// the state described by its spec. It is idempotent, so it is safe to call
+// any number of times for the same key; a returned error makes the
+// controller retry the key with a rate limit
+func (t *AzureFunctionsHandler) Reconcile(ctx context.Context, key string) (Result, error) {
+	logger := logging.FromContext(ctx)
+	logger.Debug("AzureFunctionsHandler.Reconcile: start")
 
-	function := obj.(*funcv1.AzureFunction)
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
 
-	deployment, err := clientSet.AppsV1().Deployments(azureFunctionsNamespace).Get(function.ObjectMeta.Name+"-deployment", metav1.GetOptions{})
-	if err == nil && deployment != nil {
-		t.UpdateFunction(deployment, function)
-	} else {
-		err := t.CreateFunction(function)
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		// a malformed key will never succeed, so don't retry it
+		logger.Errorf("AzureFunctionsHandler.Reconcile: invalid key %q: %v", key, err)
+		return Result{}, nil
+	}
+
+	cached, err := t.FunctionsLister.AzureFunctions(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return Result{}, t.reconcileDeleted(namespace, name)
+	}
+	if err != nil {
+		return Result{}, err
+	}
+
+	function := cached.DeepCopy()
+
+	if function.DeletionTimestamp != nil {
+		return Result{}, t.finalize(ctx, function)
+	}
+
+	if !hasFinalizer(function) {
+		function.Finalizers = append(function.Finalizers, functionFinalizer)
+
+		updated, err := t.FunctionsClient.DevV1().AzureFunctions(function.Namespace).Update(function)
 		if err != nil {
-			fmt.Println("Error creating function - " + err.Error())
+			return Result{}, t.recordWarning(function, reasonFinalizerFailed, err)
 		}
+
+		function = updated
 	}
+
+	result, err := t.reconcileFunction(ctx, function)
+
+	function.Status.ObservedGeneration = function.Generation
+	if !apiequality.Semantic.DeepEqual(cached.Status, function.Status) {
+		statusErr := t.updateFunctionStatus(function)
+		if statusErr != nil {
+			t.recordWarning(function, reasonStatusUpdateFailed, statusErr)
+
+			if err == nil {
+				err = statusErr
+			}
+		}
+
+		if statusErr == nil {
+			t.recordTransitions(&cached.Status, function)
+		}
+
+		if statusErr == nil && cached.Status.URL == "" && function.Status.URL != "" {
+			metrics.URLAssignmentDuration.Observe(time.Since(function.CreationTimestamp.Time).Seconds())
+		}
+	}
+
+	return result, err
 }
 
-func (t *AzureFunctionsHandler) ObjectDeleted(obj interface{}) {
-	log.Info("AzureFunctionsHandler.ObjectDeleted")
+// reconcileDeleted runs for functions that are gone from the cache. The
+// finalizer normally guarantees cleanup has already happened, this catches
+// functions in the shared namespace that were deleted without one
+func (t *AzureFunctionsHandler) reconcileDeleted(namespace string, name string) error {
+	if t.SharedNamespace == "" {
+		return nil
+	}
+
+	deleted, err := t.DeleteFunction(t.SharedNamespace, namespace, name)
+	if err != nil {
+		return err
+	}
+
+	if !deleted {
+		return fmt.Errorf("resources of function %s still exist", name)
+	}
 
-	rawKey := obj.(string)
-	functionName := rawKey[strings.Index(rawKey, "/")+1 : len(rawKey)]
-	t.DeleteFunction(functionName)
+	return nil
 }
 
-func (t *AzureFunctionsHandler) UpdateFunction(deployment *appsv1.Deployment, function *funcv1.AzureFunction) {
-	deployment.Spec.Template.Spec.Containers[0].Image = function.Spec.Image
-	_, err := clientSet.AppsV1().Deployments(azureFunctionsNamespace).Update(deployment)
+func (t *AzureFunctionsHandler) reconcileFunction(ctx context.Context, function *funcv1.AzureFunction) (Result, error) {
+	namespace := t.workloadNamespace(function)
+	routed := len(function.Spec.IngressRoutes()) > 0
+
+	// private functions are never routed, even when admission didn't
+	// reject a route set on them
+	//
+	// routing follows the spec and the configuration only. An ingress
+	// component that isn't running keeps the Ingresses of the functions,
+	// which is reported on their Routed condition
+	ingressEnabled := routed && function.Spec.AccessPolicy != funcv1.AccessPolicyPrivate &&
+		t.ConfiguredIngressComponent() != nil
+
+	configHash, err := t.configHash(function)
 	if err != nil {
-		fmt.Println("Error updating deployment - " + err.Error())
-		return
+		return Result{}, t.recordWarning(function, reasonConfigFailed, err)
 	}
 
-	ingressEnabled := function.Spec.IngressRoute != "" && t.IngressComponent != nil && t.IsComponentAvailable(t.IngressComponent)
+	err = t.applyImagePullSecret(function)
+	if err != nil {
+		return Result{}, t.recordWarning(function, reasonPullSecretFailed, err)
+	}
 
-	if ingressEnabled {
-		ingressName := function.ObjectMeta.Name + "-ingress"
-		ingress, err := clientSet.ExtensionsV1beta1().Ingresses(azureFunctionsNamespace).Get(ingressName, metav1.GetOptions{})
-		rules := ingress.Spec.Rules
+	desiredDeployment, err := t.desiredDeployment(function, configHash)
+	if err != nil {
+		return Result{}, t.recordWarning(function, reasonPodTemplateFailed, err)
+	}
 
-		if err == nil && ingress != nil && len(rules) > 0 {
-			http := *rules[0].HTTP
+	_, err = t.DeploymentsLister.Deployments(namespace).Get(desiredDeployment.Name)
+	created := errors.IsNotFound(err)
 
-			if http.Paths[0].Path != function.Spec.IngressRoute {
-				http.Paths[0].Path = function.Spec.IngressRoute
-				ingress.Spec.Rules[0].HTTP = &http
+	t.floorReplicas(function, desiredDeployment)
 
-				_, err := clientSet.ExtensionsV1beta1().Ingresses(azureFunctionsNamespace).Update(ingress)
-				if err != nil {
-					fmt.Println("Error updating ingress - " + err.Error())
-					return
-				}
+	deployment, err := t.applyDeployment(desiredDeployment)
+	if err != nil {
+		return Result{}, t.recordWarning(function, reasonDeploymentFailed, err)
+	}
 
-				fmt.Println(ingress.Status.LoadBalancer.Ingress[0].IP)
+	if created {
+		t.recordEvent(function, apiv1.EventTypeNormal, reasonCreated, "Created deployment "+deployment.Namespace+"/"+deployment.Name)
+	}
 
-				function.Spec.URL = "http://" + ingress.Status.LoadBalancer.Ingress[0].IP + function.Spec.IngressRoute
+	burstReplicas, err := t.reconcileBurst(function, desiredDeployment)
+	if err != nil {
+		return Result{}, t.recordWarning(function, reasonDeploymentFailed, err)
+	}
 
-				_, err = t.FunctionsClient.DevV1().AzureFunctions(function.Namespace).Update(function)
-				if err != nil {
-					fmt.Println("Error updating Function - " + err.Error())
-					return
-				}
-			}
-		}
-	} else {
-		if strings.ToLower(function.Spec.AccessPolicy) == "private" {
-			svc, err := clientSet.CoreV1().Services(azureFunctionsNamespace).Get(function.ObjectMeta.Name+"-service", metav1.GetOptions{})
-			if err != nil {
-				fmt.Println("Error getting service - " + err.Error())
-				return
-			}
+	function.Status.ReadyReplicas = deployment.Status.ReadyReplicas + burstReplicas
+	t.setImagePulledCondition(function)
+
+	autoscaler, err := t.applyAutoscaler(t.desiredAutoscaler(function))
+	if err != nil {
+		function.Status.SetCondition(funcv1.FunctionScaled, apiv1.ConditionFalse, "AutoscalerFailed", err.Error())
+		return Result{}, t.recordWarning(function, reasonAutoscalerFailed, err)
+	}
+
+	function.Status.SetCondition(funcv1.FunctionScaled, apiv1.ConditionTrue, "AutoscalerReady", fmt.Sprintf("Scaling between %d and %d replicas", *autoscaler.Spec.MinReplicas, autoscaler.Spec.MaxReplicas))
+
+	service, err := t.applyService(t.desiredService(function, ingressEnabled))
+	if err != nil {
+		return Result{}, t.recordWarning(function, reasonServiceFailed, err)
+	}
+
+	var routes []functionRoute
+	if ingressEnabled {
+		candidates, conflicts := t.functionRoutes(function)
 
-			svc.Spec.Type = apiv1.ServiceTypeClusterIP
-			svc.Spec.Ports[0].NodePort = 0
+		desiredIngresses := map[string]bool{}
+		paths := []string{}
+		invalid := []string{}
 
-			_, err = clientSet.CoreV1().Services(azureFunctionsNamespace).Update(svc)
+		for _, route := range candidates {
+			// a route that can't be rendered is reported rather than
+			// failing the routes of the function that can
+			desiredIngress, err := t.desiredIngress(function, route)
 			if err != nil {
-				fmt.Println("Error updating service - " + err.Error())
-				return
+				invalid = append(invalid, err.Error())
+				continue
 			}
 
-			function.Spec.URL = "http://" + svc.Spec.ClusterIP
-
-			_, err = t.FunctionsClient.DevV1().AzureFunctions(function.Namespace).Update(function)
+			_, err = t.applyIngress(desiredIngress)
 			if err != nil {
-				fmt.Println("Error updating Function - " + err.Error())
+				function.Status.SetCondition(funcv1.FunctionRouted, apiv1.ConditionFalse, "IngressFailed", err.Error())
+				return Result{}, t.recordWarning(function, reasonIngressFailed, err)
 			}
+
+			routes = append(routes, route)
+			desiredIngresses[route.ingressName] = true
+			paths = append(paths, route.Host+route.Path)
+		}
+
+		err = t.deleteStaleIngresses(function, desiredIngresses)
+		if err != nil {
+			return Result{}, t.recordWarning(function, reasonIngressFailed, err)
+		}
+
+		// routes that don't conflict are served, the others are
+		// routed once the function holding them releases them
+		if t.IngressComponent == nil || !t.IsComponentAvailable(t.IngressComponent) {
+			function.Status.SetCondition(funcv1.FunctionRouted, apiv1.ConditionFalse, reasonIngressUnavailable, "Ingress component "+t.Ingress+" is not running")
+		} else if len(invalid) > 0 {
+			function.Status.SetCondition(funcv1.FunctionRouted, apiv1.ConditionFalse, reasonInvalidRoute, strings.Join(invalid, "; "))
+		} else if len(conflicts) > 0 {
+			function.Status.SetCondition(funcv1.FunctionRouted, apiv1.ConditionFalse, reasonRouteConflict, strings.Join(conflicts, "; "))
+		} else {
+			function.Status.SetCondition(funcv1.FunctionRouted, apiv1.ConditionTrue, "IngressReady", "Routed "+strings.Join(paths, ", "))
+		}
+	} else {
+		err = t.deleteStaleIngresses(function, nil)
+		if err != nil {
+			return Result{}, t.recordWarning(function, reasonIngressFailed, err)
+		}
+
+		if routed && function.Spec.AccessPolicy == funcv1.AccessPolicyPrivate {
+			function.Status.SetCondition(funcv1.FunctionRouted, apiv1.ConditionFalse, "PrivateAccess", "Private functions are not routed")
+		} else if routed {
+			function.Status.SetCondition(funcv1.FunctionRouted, apiv1.ConditionFalse, reasonIngressUnavailable, "No ingress component is configured")
+		} else {
+			function.Status.SetCondition(funcv1.FunctionRouted, apiv1.ConditionFalse, "NoIngressRoute", "No ingress route is set")
 		}
 	}
-}
 
-func (t *AzureFunctionsHandler) DeleteFunction(name string) {
-	deploymentName := name + "-deployment"
-	serviceName := name + "-service"
-	ingressName := name + "-ingress"
-	hpaName := name
+	installed := []struct {
+		name      string
+		component components.Component
+	}{
+		{t.Ingress, t.IngressComponent},
+		{t.Mesh, t.MeshComponent},
+	}
+
+	for _, i := range installed {
+		if err := ctx.Err(); err != nil {
+			return Result{}, err
+		}
+
+		functionComponent, ok := i.component.(components.FunctionComponent)
+		if !ok {
+			continue
+		}
 
-	_ = clientSet.AppsV1().Deployments(azureFunctionsNamespace).Delete(deploymentName, &metav1.DeleteOptions{})
-	_ = clientSet.AutoscalingV1().HorizontalPodAutoscalers(azureFunctionsNamespace).Delete(hpaName, &metav1.DeleteOptions{})
-	_ = clientSet.CoreV1().Services(azureFunctionsNamespace).Delete(serviceName, &metav1.DeleteOptions{})
+		logging.FromContext(ctx).WithField(logging.FieldComponent, strings.ToLower(i.name)).Debug("AzureFunctionsHandler.reconcileFunction: reconciling component")
 
-	if t.IngressComponent != nil && t.IsComponentAvailable(t.IngressComponent) {
-		_ = clientSet.ExtensionsV1beta1().Ingresses(azureFunctionsNamespace).Delete(ingressName, &metav1.DeleteOptions{})
+		err = functionComponent.ReconcileFunction(function, namespace)
+		if err != nil {
+			return Result{}, t.recordWarning(function, reasonComponentFailed, err)
+		}
 	}
-}
 
-func (t *AzureFunctionsHandler) CreateFunction(function *funcv1.AzureFunction) error {
-	ingressEnabled := false
+	// the load balancer address is assigned asynchronously by the cloud
+	// provider. Rather than waiting for it, the function is marked pending
+	// and reconciled again when the watched service gets an address
+	url, pendingReason, err := t.functionURL(function, service, ingressEnabled, routes)
+	if err != nil {
+		return Result{}, t.recordWarning(function, reasonURLFailed, err)
+	}
+
+	function.Status.URL = url
+
+	if url == "" {
+		function.Status.SetCondition(funcv1.FunctionPending, apiv1.ConditionTrue, pendingReason, "Waiting for an address to be assigned")
+	} else {
+		function.Status.SetCondition(funcv1.FunctionPending, apiv1.ConditionFalse, "AddressAssigned", "Function is reachable at "+url)
+	}
+
+	t.setReadyCondition(function)
+
+	return Result{}, nil
+}
 
-	if t.IngressComponent != nil {
-		ingressEnabled = t.IsComponentAvailable(t.IngressComponent) && function.Spec.IngressRoute != ""
+// finalize tears down a function that is being deleted and only releases
+// the finalizer once all of its resources are confirmed gone
+func (t *AzureFunctionsHandler) finalize(ctx context.Context, function *funcv1.AzureFunction) error {
+	if !hasFinalizer(function) {
+		return nil
 	}
 
-	minReplicas := int32Ptr(1)
-	maxReplicas := int32(1000)
+	deleted, err := t.DeleteFunction(t.workloadNamespace(function), function.Namespace, function.Name)
+	if err != nil || !deleted {
+		reason := "CleanupPending"
+		message := "Waiting for function resources to be deleted"
+
+		if err != nil {
+			reason = reasonCleanupFailed
+			message = err.Error()
+		} else {
+			err = fmt.Errorf("resources of function %s/%s still exist", function.Namespace, function.Name)
+		}
 
-	if function.Spec.Min != nil && *function.Spec.Min > 1 {
-		minReplicas = function.Spec.Min
+		function.Status.SetCondition(funcv1.FunctionCleanedUp, apiv1.ConditionFalse, reason, message)
+
+		if reason == reasonCleanupFailed {
+			t.recordEvent(function, apiv1.EventTypeWarning, reasonCleanupFailed, message)
+		}
+
+		statusErr := t.updateFunctionStatus(function)
+		if statusErr != nil {
+			logging.FromContext(ctx).Errorf("AzureFunctionsHandler.finalize: updating status: %v", statusErr)
+		}
+
+		return err
 	}
 
-	if function.Spec.Max != nil && *function.Spec.Max > 1 {
-		maxReplicas = *function.Spec.Max
+	finalizers := []string{}
+	for _, finalizer := range function.Finalizers {
+		if finalizer != functionFinalizer {
+			finalizers = append(finalizers, finalizer)
+		}
+	}
+
+	function.Finalizers = finalizers
+
+	_, err = t.FunctionsClient.DevV1().AzureFunctions(function.Namespace).Update(function)
+	if err != nil {
+		return t.recordWarning(function, reasonFinalizerFailed, err)
 	}
 
-	deploymentName := function.ObjectMeta.Name + "-deployment"
+	return nil
+}
 
-	deployment := appsv1.Deployment{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      deploymentName,
-			Namespace: azureFunctionsNamespace,
+// DeleteFunction deletes every resource created for a function, including
+// the ones added by components, and reports whether all of them are gone.
+// The resources are in namespace, and functionNamespace is the namespace of
+// the function itself
+func (t *AzureFunctionsHandler) DeleteFunction(namespace string, functionNamespace string, name string) (bool, error) {
+	deployment := deploymentName(name)
+	burst := burstDeploymentName(name)
+	service := serviceName(name)
+	ingress := ingressName(name)
+	routeIngresses := metav1.ListOptions{LabelSelector: functionNameLabel + "=" + name}
+	autoscaler := autoscalerName(name)
+
+	deleteOptions := &metav1.DeleteOptions{}
+	getOptions := metav1.GetOptions{}
+
+	// the ingress is deleted even if the ingress component is unhealthy
+	// or disabled, it may have been created while it was available
+	deletes := []func() error{
+		func() error {
+			return clientSet.AppsV1().Deployments(namespace).Delete(deployment, deleteOptions)
+		},
+		func() error {
+			return clientSet.AppsV1().Deployments(namespace).Delete(burst, deleteOptions)
+		},
+		func() error {
+			return clientSet.AutoscalingV2beta2().HorizontalPodAutoscalers(namespace).Delete(autoscaler, deleteOptions)
 		},
-		Spec: appsv1.DeploymentSpec{
-			Replicas: int32Ptr(1),
-			Selector: &metav1.LabelSelector{
-				MatchLabels: map[string]string{
-					"app": function.ObjectMeta.Name,
-				},
-			},
-			Template: apiv1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
-						"app": function.ObjectMeta.Name,
-					},
-				},
-				Spec: apiv1.PodSpec{
-					Containers: []apiv1.Container{
-						{
-							Name:  function.ObjectMeta.Name,
-							Image: function.Spec.Image,
-							Ports: []apiv1.ContainerPort{
-								{
-									Name:          "http",
-									Protocol:      apiv1.ProtocolTCP,
-									ContainerPort: 80,
-								},
-							},
-						},
-					},
-					Tolerations: []v1.Toleration{
-						{
-							Key:   "azure.com/aci",
-							Value: "NoSchedule",
-						},
-					},
-				},
-			},
+		func() error {
+			return clientSet.CoreV1().Services(namespace).Delete(service, deleteOptions)
+		},
+		func() error {
+			return clientSet.ExtensionsV1beta1().Ingresses(namespace).Delete(ingress, deleteOptions)
+		},
+		func() error {
+			return clientSet.ExtensionsV1beta1().Ingresses(namespace).DeleteCollection(deleteOptions, routeIngresses)
 		},
 	}
 
-	autoscaler := autoscalerv1.HorizontalPodAutoscaler{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      function.ObjectMeta.Name,
-			Namespace: azureFunctionsNamespace,
+	gets := []func() error{
+		func() error {
+			_, err := clientSet.AppsV1().Deployments(namespace).Get(deployment, getOptions)
+			return err
 		},
-		Spec: autoscalerv1.HorizontalPodAutoscalerSpec{
-			MinReplicas:                    minReplicas,
-			MaxReplicas:                    maxReplicas,
-			TargetCPUUtilizationPercentage: int32Ptr(60),
-			ScaleTargetRef: autoscalerv1.CrossVersionObjectReference{
-				APIVersion: "apps/v1",
-				Kind:       "Deployment",
-				Name:       deploymentName,
-			},
+		func() error {
+			_, err := clientSet.AppsV1().Deployments(namespace).Get(burst, getOptions)
+			return err
+		},
+		func() error {
+			_, err := clientSet.AutoscalingV2beta2().HorizontalPodAutoscalers(namespace).Get(autoscaler, getOptions)
+			return err
+		},
+		func() error {
+			_, err := clientSet.CoreV1().Services(namespace).Get(service, getOptions)
+			return err
+		},
+		func() error {
+			_, err := clientSet.ExtensionsV1beta1().Ingresses(namespace).Get(ingress, getOptions)
+			return err
+		},
+		func() error {
+			list, err := clientSet.ExtensionsV1beta1().Ingresses(namespace).List(routeIngresses)
+			if err == nil && len(list.Items) == 0 {
+				return errors.NewNotFound(v1beta1.Resource("ingresses"), name)
+			}
+
+			return err
 		},
 	}
 
-	_, err := clientSet.AppsV1().Deployments(azureFunctionsNamespace).Create(&deployment)
-	if err != nil {
-		return err
+	errs := []error{}
+	for _, del := range deletes {
+		err := del()
+		if err != nil && !errors.IsNotFound(err) {
+			errs = append(errs, err)
+		}
 	}
 
-	_, err = clientSet.AutoscalingV1().HorizontalPodAutoscalers(azureFunctionsNamespace).Create(&autoscaler)
-	if err != nil {
-		return err
+	allDeleted := true
+	for _, component := range []components.Component{t.IngressComponent, t.MeshComponent} {
+		finalizing, ok := component.(components.FinalizingComponent)
+		if !ok {
+			continue
+		}
+
+		deleted, err := finalizing.DeleteFunctionResources(namespace, functionNamespace, name)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		allDeleted = allDeleted && deleted
 	}
 
-	isPrivateAccess := strings.ToLower(function.Spec.AccessPolicy) == "private"
+	if len(errs) > 0 {
+		return false, utilerrors.NewAggregate(errs)
+	}
 
-	serviceName := function.ObjectMeta.Name + "-service"
-	servicePort := 80
-	var serviceType apiv1.ServiceType
+	for _, get := range gets {
+		err := get()
+		if err == nil {
+			allDeleted = false
+		} else if !errors.IsNotFound(err) {
+			return false, err
+		}
+	}
 
-	if isPrivateAccess || ingressEnabled {
-		serviceType = apiv1.ServiceTypeClusterIP
-	} else {
-		serviceType = apiv1.ServiceTypeLoadBalancer
+	return allDeleted, nil
+}
+
+// workloadNamespace returns the namespace the child resources of a function live in
+func (t *AzureFunctionsHandler) workloadNamespace(function *funcv1.AzureFunction) string {
+	if t.SharedNamespace != "" {
+		return t.SharedNamespace
 	}
 
-	service := v1.Service{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      serviceName,
-			Namespace: azureFunctionsNamespace,
-		},
-		Spec: apiv1.ServiceSpec{
-			Selector: map[string]string{
-				"app": function.ObjectMeta.Name,
-			},
-			Ports: []apiv1.ServicePort{
-				{
-					Name:     "http",
-					Protocol: apiv1.ProtocolTCP,
-					Port:     int32(servicePort),
-				},
-			},
-			Type: serviceType,
-		},
+	return function.Namespace
+}
+
+// childObjectMeta builds the metadata for a resource created on behalf of a
+// function. Owner references can't cross namespaces, so resources in the
+// shared namespace are left without one and are deleted explicitly
+func (t *AzureFunctionsHandler) childObjectMeta(function *funcv1.AzureFunction, name string) metav1.ObjectMeta {
+	meta := metav1.ObjectMeta{
+		Name:      name,
+		Namespace: t.workloadNamespace(function),
+		Labels:    functionLabels(function),
+	}
+
+	if t.SharedNamespace == "" {
+		meta.OwnerReferences = []metav1.OwnerReference{
+			*metav1.NewControllerRef(function, funcv1.SchemeGroupVersion.WithKind("AzureFunction")),
+		}
+	}
+
+	return meta
+}
+
+// setReadyCondition marks the function ready once it has a URL and a ready
+// replica. Until then the reason tells what it is waiting for, such as a
+// failing probe of its pods
+func (t *AzureFunctionsHandler) setReadyCondition(function *funcv1.AzureFunction) {
+	if function.Status.URL == "" {
+		function.Status.SetCondition(funcv1.FunctionReady, apiv1.ConditionFalse, "URLPending", "Waiting for an address to be assigned")
+		return
+	}
+
+	if function.Status.ReadyReplicas == 0 {
+		reason, message := t.podsNotReadyReason(function)
+		function.Status.SetCondition(funcv1.FunctionReady, apiv1.ConditionFalse, reason, message)
+		return
 	}
 
-	_, err = clientSet.CoreV1().Services(azureFunctionsNamespace).Create(&service)
+	function.Status.SetCondition(funcv1.FunctionReady, apiv1.ConditionTrue, "URLAssigned", "Function is reachable at "+function.Status.URL)
+}
+
+// updateFunctionStatus writes the status subresource only, so the spec owned
+// by the user is never touched and no spec update events are generated
+func (t *AzureFunctionsHandler) updateFunctionStatus(function *funcv1.AzureFunction) error {
+	function.Status.ObservedGeneration = function.Generation
+
+	updated, err := t.FunctionsClient.DevV1().AzureFunctions(function.Namespace).UpdateStatus(function)
 	if err != nil {
 		return err
 	}
 
-	functionServiceName := serviceName
-	namespace := azureFunctionsNamespace
+	function.ResourceVersion = updated.ResourceVersion
+	return nil
+}
 
-	if ingressEnabled {
-		ingressComponent := t.IngressComponent.(components.IngressComponent)
-		ingressName := function.ObjectMeta.Name + "-ingress"
-
-		ingressRule := v1beta1.IngressRule{}
-		ingressRule.HTTP = &v1beta1.HTTPIngressRuleValue{
-			Paths: []v1beta1.HTTPIngressPath{
-				{
-					Path: function.Spec.IngressRoute,
-					Backend: v1beta1.IngressBackend{
-						ServiceName: serviceName,
-						ServicePort: intstr.FromInt(servicePort),
-					},
-				},
-			},
-		}
-
-		_, err := clientSet.ExtensionsV1beta1().Ingresses(azureFunctionsNamespace).Create(&v1beta1.Ingress{
-			ObjectMeta: metav1.ObjectMeta{
-				Name: ingressName,
-				Annotations: map[string]string{
-					"nginx.ingress.kubernetes.io/rewrite-target": "/",
-					"nginx.ingress.kubernetes.io/ssl-redirect":   strconv.FormatBool(false),
-				},
-			},
-			Spec: v1beta1.IngressSpec{
-				Rules: []v1beta1.IngressRule{
-					ingressRule,
-				},
-			},
-		})
+// componentPodAnnotations returns the annotations the installed components
+// need on the pods of functions
+func (t *AzureFunctionsHandler) componentPodAnnotations() map[string]string {
+	annotations := map[string]string{}
 
-		if err != nil {
-			return err
+	for _, component := range []components.Component{t.IngressComponent, t.MeshComponent} {
+		podComponent, ok := component.(components.PodComponent)
+		if !ok {
+			continue
 		}
 
-		functionServiceName = ingressComponent.ServiceName()
-		namespace = ingressComponent.Namespace()
+		for key, value := range podComponent.PodAnnotations() {
+			annotations[key] = value
+		}
 	}
 
-	t.UpdateFunctionPublicIP(functionServiceName, namespace, function, ingressEnabled)
-
-	return nil
+	return annotations
 }
 
-func (t *AzureFunctionsHandler) UpdateFunctionPublicIP(serviceName string, namespace string, function *funcv1.AzureFunction, ingressEnabled bool) {
-	ip := ""
+// ComponentsHealthy returns an error naming the first required component that
+// isn't registered or isn't running
+func (t *AzureFunctionsHandler) ComponentsHealthy() error {
+	for _, name := range []string{t.Ingress, t.Mesh} {
+		if name == "" {
+			continue
+		}
 
-	for ip == "" {
-		svc, err := clientSet.CoreV1().Services(namespace).Get(serviceName, metav1.GetOptions{})
+		component, err := components.GetComponent(strings.ToLower(name))
 		if err != nil {
-			fmt.Println("Error getting service - " + err.Error())
-			return
+			return err
 		}
 
-		if !ingressEnabled && strings.ToLower(function.Spec.AccessPolicy) == "private" {
-			ip = svc.Spec.ClusterIP
-		} else {
-			if svc.Status.LoadBalancer.Ingress != nil && len(svc.Status.LoadBalancer.Ingress) > 0 {
-				ip = svc.Status.LoadBalancer.Ingress[0].IP
-			}
+		if !t.IsComponentAvailable(component) {
+			return fmt.Errorf("component %s is not running", name)
 		}
+	}
 
-		if ip != "" {
-			function.Spec.URL = "http://" + ip
+	return nil
+}
 
-			if ingressEnabled {
-				function.Spec.URL += function.Spec.IngressRoute
-			}
+// ReportComponentHealth exports whether the installed ingress and mesh
+// components are running
+func (t *AzureFunctionsHandler) ReportComponentHealth() {
+	reportHealth := func(name string, componentType string, component components.Component) {
+		if component == nil {
+			return
+		}
 
-			_, err := t.FunctionsClient.DevV1().AzureFunctions(function.Namespace).Update(function)
-			if err != nil {
-				fmt.Println("Error updating Function - " + err.Error())
-			}
+		healthy := 0.0
+		if t.IsComponentAvailable(component) {
+			healthy = 1
 		}
 
-		time.Sleep(time.Second * 1)
+		metrics.ComponentHealthy.WithLabelValues(strings.ToLower(name), componentType).Set(healthy)
 	}
+
+	reportHealth(t.Ingress, "ingress", t.IngressComponent)
+	reportHealth(t.Mesh, "mesh", t.MeshComponent)
 }
 
 func (t *AzureFunctionsHandler) IsComponentAvailable(component components.Component) bool {
@@ -454,4 +740,14 @@ func (t *AzureFunctionsHandler) IsComponentAvailable(component components.Compon
 	return (err == nil && isRunning)
 }
 
+func hasFinalizer(function *funcv1.AzureFunction) bool {
+	for _, finalizer := range function.Finalizers {
+		if finalizer == functionFinalizer {
+			return true
+		}
+	}
+
+	return false
+}
+
 func int32Ptr(i int32) *int32 { return &i }
@@ -0,0 +1,787 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/yaron2/azfuncs/components"
+	"github.com/yaron2/azfuncs/config"
+	funcv1 "github.com/yaron2/azfuncs/pkg/apis/azurefunctions/v1"
+	"github.com/yaron2/azfuncs/pkg/client/clientset/versioned/fake"
+	listers "github.com/yaron2/azfuncs/pkg/client/listers/azurefunctions/v1"
+	"github.com/yaron2/azfuncs/pkg/validation"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/api/extensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	autoscalinglisters "k8s.io/client-go/listers/autoscaling/v2beta2"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	extensionslisters "k8s.io/client-go/listers/extensions/v1beta1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	testNamespace = "default"
+	testName      = "orders"
+)
+
+// fakeIngressComponent stands in for the nginx component, which asks the API
+// server whether it is running
+type fakeIngressComponent struct {
+	down bool
+}
+
+func (c *fakeIngressComponent) Install() (components.Component, error) { return c, nil }
+func (c *fakeIngressComponent) Namespace() string                      { return "ingress-nginx" }
+func (c *fakeIngressComponent) ServiceName() string                    { return "ingress-nginx" }
+func (c *fakeIngressComponent) IsRunning() (bool, error)               { return !c.down, nil }
+
+// fakeMeshComponent stands in for a mesh that injects sidecars into pods
+// annotated for it
+type fakeMeshComponent struct{}
+
+func (c *fakeMeshComponent) Install() (components.Component, error) { return c, nil }
+func (c *fakeMeshComponent) Namespace() string                      { return "mesh-system" }
+func (c *fakeMeshComponent) IsRunning() (bool, error)               { return true, nil }
+func (c *fakeMeshComponent) PodAnnotations() map[string]string {
+	return map[string]string{"sidecar.mesh.example.com/inject": "true"}
+}
+
+// testEnv runs the handler against fake clientsets. The informer caches are
+// replaced by indexers that are refilled from the fake clientsets around
+// every reconcile
+type testEnv struct {
+	t         *testing.T
+	kube      *kubefake.Clientset
+	functions *fake.Clientset
+	handler   *AzureFunctionsHandler
+	caches    []testCache
+}
+
+type testCache struct {
+	indexer cache.Indexer
+	list    func() (runtime.Object, error)
+}
+
+func newIndexer(indexers cache.Indexers) cache.Indexer {
+	indexers[cache.NamespaceIndex] = cache.MetaNamespaceIndexFunc
+	return cache.NewIndexer(cache.MetaNamespaceKeyFunc, indexers)
+}
+
+func newTestEnv(t *testing.T, objects ...runtime.Object) *testEnv {
+	ingressService := &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "ingress-nginx", Namespace: "ingress-nginx"},
+		Status: apiv1.ServiceStatus{
+			LoadBalancer: apiv1.LoadBalancerStatus{
+				Ingress: []apiv1.LoadBalancerIngress{{IP: "10.0.0.1"}},
+			},
+		},
+	}
+
+	e := &testEnv{
+		t:         t,
+		kube:      kubefake.NewSimpleClientset(append(objects, ingressService)...),
+		functions: fake.NewSimpleClientset(),
+	}
+
+	clientSet = e.kube
+
+	e.handler = &AzureFunctionsHandler{
+		Ingress:          "nginx",
+		IngressComponent: &fakeIngressComponent{},
+		FunctionsClient:  e.functions,
+		Config:           config.NewStore(config.Default()),
+	}
+
+	functions := newIndexer(cache.Indexers{
+		ConfigReferencesIndex: e.handler.ConfigReferencesIndexFunc,
+		RoutesIndex:           e.handler.RoutesIndexFunc,
+	})
+	deployments := newIndexer(cache.Indexers{})
+	autoscalers := newIndexer(cache.Indexers{})
+	services := newIndexer(cache.Indexers{})
+	ingresses := newIndexer(cache.Indexers{})
+	pods := newIndexer(cache.Indexers{})
+	configMaps := newIndexer(cache.Indexers{})
+	secrets := newIndexer(cache.Indexers{})
+	nodes := newIndexer(cache.Indexers{})
+
+	e.handler.FunctionsLister = listers.NewAzureFunctionLister(functions)
+	e.handler.FunctionsIndexer = functions
+	e.handler.DeploymentsLister = appslisters.NewDeploymentLister(deployments)
+	e.handler.AutoscalersLister = autoscalinglisters.NewHorizontalPodAutoscalerLister(autoscalers)
+	e.handler.ServicesLister = corelisters.NewServiceLister(services)
+	e.handler.IngressesLister = extensionslisters.NewIngressLister(ingresses)
+	e.handler.PodsLister = corelisters.NewPodLister(pods)
+	e.handler.ConfigMapsLister = corelisters.NewConfigMapLister(configMaps)
+	e.handler.SecretsLister = corelisters.NewSecretLister(secrets)
+	e.handler.IngressServiceLister = corelisters.NewServiceLister(services)
+	e.handler.NodesLister = corelisters.NewNodeLister(nodes)
+	e.handler.ControllerSecretsLister = corelisters.NewSecretLister(secrets)
+
+	all := metav1.ListOptions{}
+	e.caches = []testCache{
+		{functions, func() (runtime.Object, error) { return e.functions.DevV1().AzureFunctions("").List(all) }},
+		{deployments, func() (runtime.Object, error) { return e.kube.AppsV1().Deployments("").List(all) }},
+		{autoscalers, func() (runtime.Object, error) {
+			return e.kube.AutoscalingV2beta2().HorizontalPodAutoscalers("").List(all)
+		}},
+		{services, func() (runtime.Object, error) { return e.kube.CoreV1().Services("").List(all) }},
+		{ingresses, func() (runtime.Object, error) { return e.kube.ExtensionsV1beta1().Ingresses("").List(all) }},
+		{pods, func() (runtime.Object, error) { return e.kube.CoreV1().Pods("").List(all) }},
+		{configMaps, func() (runtime.Object, error) { return e.kube.CoreV1().ConfigMaps("").List(all) }},
+		{secrets, func() (runtime.Object, error) { return e.kube.CoreV1().Secrets("").List(all) }},
+		{nodes, func() (runtime.Object, error) { return e.kube.CoreV1().Nodes().List(all) }},
+	}
+
+	return e
+}
+
+// sync refills the caches of the handler from the fake clientsets
+func (e *testEnv) sync() {
+	e.t.Helper()
+
+	for _, c := range e.caches {
+		list, err := c.list()
+		if err != nil {
+			e.t.Fatal(err)
+		}
+
+		objects, err := meta.ExtractList(list)
+		if err != nil {
+			e.t.Fatal(err)
+		}
+
+		items := []interface{}{}
+		for _, object := range objects {
+			items = append(items, object)
+		}
+
+		if err := c.indexer.Replace(items, ""); err != nil {
+			e.t.Fatal(err)
+		}
+	}
+}
+
+// apply creates or updates the function with the given spec, defaulted the
+// way the admission webhook does, and reconciles it
+func (e *testEnv) apply(spec funcv1.AzureFunctionSpec) {
+	e.t.Helper()
+
+	function := &funcv1.AzureFunction{
+		ObjectMeta: metav1.ObjectMeta{Name: testName, Namespace: testNamespace},
+		Spec:       spec,
+	}
+	validation.SetDefaults(function)
+
+	client := e.functions.DevV1().AzureFunctions(testNamespace)
+
+	existing, err := client.Get(testName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = client.Create(function)
+	} else if err == nil {
+		existing.Spec = function.Spec
+		_, err = client.Update(existing)
+	}
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	e.reconcile()
+}
+
+func (e *testEnv) reconcile() {
+	e.t.Helper()
+
+	e.sync()
+
+	_, err := e.handler.Reconcile(context.Background(), testNamespace+"/"+testName)
+	if err != nil {
+		e.t.Fatalf("reconcile failed: %v", err)
+	}
+
+	e.sync()
+}
+
+func (e *testEnv) deployment(name string) *appsv1.Deployment {
+	e.t.Helper()
+
+	deployment, err := e.kube.AppsV1().Deployments(testNamespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	return deployment
+}
+
+func (e *testEnv) container() apiv1.Container {
+	e.t.Helper()
+	return e.deployment(deploymentName(testName)).Spec.Template.Spec.Containers[0]
+}
+
+func (e *testEnv) podSpec() apiv1.PodSpec {
+	e.t.Helper()
+	return e.deployment(deploymentName(testName)).Spec.Template.Spec
+}
+
+func (e *testEnv) autoscaler() *autoscalingv2beta2.HorizontalPodAutoscaler {
+	e.t.Helper()
+
+	autoscaler, err := e.kube.AutoscalingV2beta2().HorizontalPodAutoscalers(testNamespace).Get(autoscalerName(testName), metav1.GetOptions{})
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	return autoscaler
+}
+
+func (e *testEnv) service() *apiv1.Service {
+	e.t.Helper()
+
+	service, err := e.kube.CoreV1().Services(testNamespace).Get(serviceName(testName), metav1.GetOptions{})
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	return service
+}
+
+func (e *testEnv) ingresses() map[string]v1beta1.Ingress {
+	e.t.Helper()
+
+	list, err := e.kube.ExtensionsV1beta1().Ingresses(testNamespace).List(metav1.ListOptions{})
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	ingresses := map[string]v1beta1.Ingress{}
+	for _, ingress := range list.Items {
+		ingresses[ingress.Name] = ingress
+	}
+
+	return ingresses
+}
+
+func (e *testEnv) function() *funcv1.AzureFunction {
+	e.t.Helper()
+
+	function, err := e.functions.DevV1().AzureFunctions(testNamespace).Get(testName, metav1.GetOptions{})
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	return function
+}
+
+// TestReconcileConvergesSpecChanges updates a function from one spec to
+// another and checks that the resources created for it follow, including
+// when a field is removed from the spec
+func TestReconcileConvergesSpecChanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		before func(spec *funcv1.AzureFunctionSpec)
+		after  func(spec *funcv1.AzureFunctionSpec)
+		check  func(t *testing.T, e *testEnv)
+	}{
+		{
+			name:  "image",
+			after: func(spec *funcv1.AzureFunctionSpec) { spec.Image = "functions/orders:2" },
+			check: func(t *testing.T, e *testEnv) {
+				if image := e.container().Image; image != "functions/orders:2" {
+					t.Errorf("expected image functions/orders:2, got %s", image)
+				}
+			},
+		},
+		{
+			name: "private to public",
+			before: func(spec *funcv1.AzureFunctionSpec) {
+				spec.AccessPolicy = funcv1.AccessPolicyPrivate
+			},
+			after: func(spec *funcv1.AzureFunctionSpec) { spec.AccessPolicy = funcv1.AccessPolicyPublic },
+			check: func(t *testing.T, e *testEnv) {
+				if serviceType := e.service().Spec.Type; serviceType != apiv1.ServiceTypeLoadBalancer {
+					t.Errorf("expected a LoadBalancer service, got %s", serviceType)
+				}
+			},
+		},
+		{
+			name:  "public to private",
+			after: func(spec *funcv1.AzureFunctionSpec) { spec.AccessPolicy = funcv1.AccessPolicyPrivate },
+			check: func(t *testing.T, e *testEnv) {
+				if serviceType := e.service().Spec.Type; serviceType != apiv1.ServiceTypeClusterIP {
+					t.Errorf("expected a ClusterIP service, got %s", serviceType)
+				}
+			},
+		},
+		{
+			name: "routed public to private",
+			before: func(spec *funcv1.AzureFunctionSpec) {
+				spec.Routes = []funcv1.Route{{Path: "/orders"}}
+			},
+			after: func(spec *funcv1.AzureFunctionSpec) {
+				spec.AccessPolicy = funcv1.AccessPolicyPrivate
+				spec.Routes = nil
+			},
+			check: func(t *testing.T, e *testEnv) {
+				if ingresses := e.ingresses(); len(ingresses) != 0 {
+					t.Errorf("expected no ingress, got %d", len(ingresses))
+				}
+			},
+		},
+		{
+			name: "min and max",
+			before: func(spec *funcv1.AzureFunctionSpec) {
+				spec.Min = int32Ptr(1)
+				spec.Max = int32Ptr(3)
+			},
+			after: func(spec *funcv1.AzureFunctionSpec) {
+				spec.Min = int32Ptr(2)
+				spec.Max = int32Ptr(5)
+			},
+			check: func(t *testing.T, e *testEnv) {
+				autoscaler := e.autoscaler()
+				if *autoscaler.Spec.MinReplicas != 2 || autoscaler.Spec.MaxReplicas != 5 {
+					t.Errorf("expected 2 to 5 replicas, got %d to %d", *autoscaler.Spec.MinReplicas, autoscaler.Spec.MaxReplicas)
+				}
+			},
+		},
+		{
+			name: "min and max removed",
+			before: func(spec *funcv1.AzureFunctionSpec) {
+				spec.Min = int32Ptr(2)
+				spec.Max = int32Ptr(5)
+			},
+			check: func(t *testing.T, e *testEnv) {
+				autoscaler := e.autoscaler()
+				if *autoscaler.Spec.MinReplicas != validation.DefaultMinReplicas || autoscaler.Spec.MaxReplicas != validation.DefaultMaxReplicas {
+					t.Errorf("expected the default replicas, got %d to %d", *autoscaler.Spec.MinReplicas, autoscaler.Spec.MaxReplicas)
+				}
+			},
+		},
+		{
+			name: "scale removed",
+			before: func(spec *funcv1.AzureFunctionSpec) {
+				spec.Scale = &funcv1.ScaleSpec{
+					Min:                               int32Ptr(3),
+					TargetCPUUtilizationPercentage:    int32Ptr(80),
+					TargetMemoryUtilizationPercentage: int32Ptr(70),
+				}
+			},
+			check: func(t *testing.T, e *testEnv) {
+				autoscaler := e.autoscaler()
+				if *autoscaler.Spec.MinReplicas != validation.DefaultMinReplicas {
+					t.Errorf("expected the default min, got %d", *autoscaler.Spec.MinReplicas)
+				}
+
+				if len(autoscaler.Spec.Metrics) != 1 || *autoscaler.Spec.Metrics[0].Resource.Target.AverageUtilization != 60 {
+					t.Errorf("expected a single CPU metric at the default target, got %v", autoscaler.Spec.Metrics)
+				}
+			},
+		},
+		{
+			name: "ingressRoute added",
+			after: func(spec *funcv1.AzureFunctionSpec) {
+				spec.IngressRoute = "/orders"
+			},
+			check: func(t *testing.T, e *testEnv) {
+				ingress, ok := e.ingresses()[ingressName(testName)]
+				if !ok {
+					t.Fatal("expected the ingress of ingressRoute")
+				}
+
+				if ingress.Annotations["nginx.ingress.kubernetes.io/rewrite-target"] != "/" {
+					t.Errorf("expected ingressRoute to be rewritten to /, got %v", ingress.Annotations)
+				}
+
+				if serviceType := e.service().Spec.Type; serviceType != apiv1.ServiceTypeClusterIP {
+					t.Errorf("expected a ClusterIP service behind the ingress, got %s", serviceType)
+				}
+
+				if url := e.function().Status.URL; url != "http://10.0.0.1/orders" {
+					t.Errorf("expected the URL of the ingress, got %s", url)
+				}
+			},
+		},
+		{
+			name: "ingressRoute removed",
+			before: func(spec *funcv1.AzureFunctionSpec) {
+				spec.IngressRoute = "/orders"
+			},
+			check: func(t *testing.T, e *testEnv) {
+				if ingresses := e.ingresses(); len(ingresses) != 0 {
+					t.Errorf("expected no ingress, got %d", len(ingresses))
+				}
+
+				if serviceType := e.service().Spec.Type; serviceType != apiv1.ServiceTypeLoadBalancer {
+					t.Errorf("expected a LoadBalancer service, got %s", serviceType)
+				}
+			},
+		},
+		{
+			name: "route removed",
+			before: func(spec *funcv1.AzureFunctionSpec) {
+				spec.Routes = []funcv1.Route{{Path: "/orders"}, {Path: "/invoices"}}
+			},
+			after: func(spec *funcv1.AzureFunctionSpec) {
+				spec.Routes = []funcv1.Route{{Path: "/orders"}}
+			},
+			check: func(t *testing.T, e *testEnv) {
+				ingresses := e.ingresses()
+				if _, ok := ingresses[routeIngressName(testName, 0)]; !ok || len(ingresses) != 1 {
+					t.Errorf("expected only the ingress of the first route, got %d", len(ingresses))
+				}
+			},
+		},
+		{
+			name: "all routes removed",
+			before: func(spec *funcv1.AzureFunctionSpec) {
+				spec.Routes = []funcv1.Route{{Path: "/orders"}, {Path: "/invoices"}}
+			},
+			check: func(t *testing.T, e *testEnv) {
+				if ingresses := e.ingresses(); len(ingresses) != 0 {
+					t.Errorf("expected no ingress, got %d", len(ingresses))
+				}
+			},
+		},
+		{
+			name: "route methods removed",
+			before: func(spec *funcv1.AzureFunctionSpec) {
+				spec.Routes = []funcv1.Route{{Path: "/orders", Methods: []funcv1.HTTPMethod{"GET"}}}
+			},
+			after: func(spec *funcv1.AzureFunctionSpec) {
+				spec.Routes = []funcv1.Route{{Path: "/orders"}}
+			},
+			check: func(t *testing.T, e *testEnv) {
+				ingress := e.ingresses()[routeIngressName(testName, 0)]
+				if _, ok := ingress.Annotations["nginx.ingress.kubernetes.io/configuration-snippet"]; ok {
+					t.Errorf("expected the method filter to be removed, got %v", ingress.Annotations)
+				}
+			},
+		},
+		{
+			name: "route method not supported",
+			before: func(spec *funcv1.AzureFunctionSpec) {
+				spec.Routes = []funcv1.Route{{Path: "/orders"}, {Path: "/invoices"}}
+			},
+			after: func(spec *funcv1.AzureFunctionSpec) {
+				spec.Routes = []funcv1.Route{
+					{Path: "/orders", Methods: []funcv1.HTTPMethod{"GET; } location / { proxy_pass http://evil; } #"}},
+					{Path: "/invoices"},
+				}
+			},
+			check: func(t *testing.T, e *testEnv) {
+				ingresses := e.ingresses()
+				if _, ok := ingresses[routeIngressName(testName, 0)]; ok {
+					t.Error("expected the route with an unsupported method not to be rendered")
+				}
+
+				if _, ok := ingresses[routeIngressName(testName, 1)]; !ok {
+					t.Error("expected the other route to stay rendered")
+				}
+
+				routed := e.function().Status.GetCondition(funcv1.FunctionRouted)
+				if routed == nil || routed.Status != apiv1.ConditionFalse || routed.Reason != reasonInvalidRoute {
+					t.Errorf("expected the route to be reported as invalid, got %v", routed)
+				}
+			},
+		},
+		{
+			name: "prefix to exact",
+			before: func(spec *funcv1.AzureFunctionSpec) {
+				spec.Routes = []funcv1.Route{{Path: "/orders"}}
+			},
+			after: func(spec *funcv1.AzureFunctionSpec) {
+				spec.Routes = []funcv1.Route{{Path: "/orders", PathType: funcv1.PathTypeExact, Methods: []funcv1.HTTPMethod{"GET"}}}
+			},
+			check: func(t *testing.T, e *testEnv) {
+				ingress := e.ingresses()[routeIngressName(testName, 0)]
+				if _, ok := ingress.Annotations["nginx.ingress.kubernetes.io/use-regex"]; ok {
+					t.Errorf("expected exact routes not to turn on regular expressions, got %v", ingress.Annotations)
+				}
+
+				snippet := "if ($uri != \"/orders\") { return 404; }\nlimit_except GET { deny all; }\n"
+				if ingress.Annotations["nginx.ingress.kubernetes.io/configuration-snippet"] != snippet {
+					t.Errorf("expected the snippet %q, got %v", snippet, ingress.Annotations)
+				}
+
+				if path := ingress.Spec.Rules[0].HTTP.Paths[0].Path; path != "/orders" {
+					t.Errorf("expected path /orders, got %s", path)
+				}
+			},
+		},
+		{
+			name: "route host changed",
+			before: func(spec *funcv1.AzureFunctionSpec) {
+				spec.Routes = []funcv1.Route{{Host: "orders.example.com", Path: "/"}}
+			},
+			after: func(spec *funcv1.AzureFunctionSpec) {
+				spec.Routes = []funcv1.Route{{Host: "shop.example.com", Path: "/"}}
+			},
+			check: func(t *testing.T, e *testEnv) {
+				ingress := e.ingresses()[routeIngressName(testName, 0)]
+				if host := ingress.Spec.Rules[0].Host; host != "shop.example.com" {
+					t.Errorf("expected host shop.example.com, got %s", host)
+				}
+			},
+		},
+		{
+			name: "grpc to http",
+			before: func(spec *funcv1.AzureFunctionSpec) {
+				spec.Protocol = funcv1.ProtocolGRPC
+				spec.IngressRoute = "/orders"
+			},
+			after: func(spec *funcv1.AzureFunctionSpec) {
+				spec.IngressRoute = "/orders"
+			},
+			check: func(t *testing.T, e *testEnv) {
+				ingress := e.ingresses()[ingressName(testName)]
+				if _, ok := ingress.Annotations["nginx.ingress.kubernetes.io/backend-protocol"]; ok {
+					t.Errorf("expected the gRPC backend protocol to be removed, got %v", ingress.Annotations)
+				}
+
+				if name := e.container().Ports[0].Name; name != funcv1.ProtocolHTTP {
+					t.Errorf("expected the main port to be named http, got %s", name)
+				}
+
+				if e.container().LivenessProbe.HTTPGet == nil {
+					t.Error("expected an HTTP liveness probe")
+				}
+			},
+		},
+		{
+			name: "port removed",
+			before: func(spec *funcv1.AzureFunctionSpec) {
+				spec.Port = int32Ptr(8080)
+			},
+			check: func(t *testing.T, e *testEnv) {
+				if port := e.container().Ports[0].ContainerPort; port != validation.DefaultPort {
+					t.Errorf("expected the default port, got %d", port)
+				}
+			},
+		},
+		{
+			name: "ports removed",
+			before: func(spec *funcv1.AzureFunctionSpec) {
+				spec.Ports = []funcv1.FunctionPort{{Name: "admin", Port: 9090}}
+			},
+			check: func(t *testing.T, e *testEnv) {
+				if ports := e.container().Ports; len(ports) != 1 {
+					t.Errorf("expected only the main container port, got %v", ports)
+				}
+
+				if ports := e.service().Spec.Ports; len(ports) != 1 {
+					t.Errorf("expected only the main service port, got %v", ports)
+				}
+			},
+		},
+		{
+			name: "appSettings and env removed",
+			before: func(spec *funcv1.AzureFunctionSpec) {
+				spec.AppSettings = map[string]funcv1.AppSetting{"FUNCTIONS_WORKER_RUNTIME": {Value: "node"}}
+				spec.Env = []apiv1.EnvVar{{Name: "LOG_LEVEL", Value: "debug"}}
+			},
+			check: func(t *testing.T, e *testEnv) {
+				if env := e.container().Env; len(env) != 0 {
+					t.Errorf("expected no env, got %v", env)
+				}
+			},
+		},
+		{
+			name: "envFrom removed",
+			before: func(spec *funcv1.AzureFunctionSpec) {
+				spec.EnvFrom = []apiv1.EnvFromSource{{
+					ConfigMapRef: &apiv1.ConfigMapEnvSource{LocalObjectReference: apiv1.LocalObjectReference{Name: "settings"}},
+				}}
+			},
+			check: func(t *testing.T, e *testEnv) {
+				if envFrom := e.container().EnvFrom; len(envFrom) != 0 {
+					t.Errorf("expected no envFrom, got %v", envFrom)
+				}
+
+				if _, ok := e.deployment(deploymentName(testName)).Spec.Template.Annotations[configHashAnnotation]; ok {
+					t.Error("expected the config hash to be removed")
+				}
+			},
+		},
+		{
+			name: "resources removed",
+			before: func(spec *funcv1.AzureFunctionSpec) {
+				spec.Resources = apiv1.ResourceRequirements{
+					Limits: apiv1.ResourceList{apiv1.ResourceMemory: resource.MustParse("256Mi")},
+				}
+			},
+			check: func(t *testing.T, e *testEnv) {
+				if limits := e.container().Resources.Limits; len(limits) != 0 {
+					t.Errorf("expected no limits, got %v", limits)
+				}
+			},
+		},
+		{
+			name: "probes removed",
+			before: func(spec *funcv1.AzureFunctionSpec) {
+				spec.Probes = &funcv1.ProbesSpec{
+					Liveness: &apiv1.Probe{Handler: apiv1.Handler{Exec: &apiv1.ExecAction{Command: []string{"true"}}}},
+				}
+			},
+			check: func(t *testing.T, e *testEnv) {
+				probe := e.container().LivenessProbe
+				if probe.Exec != nil || probe.HTTPGet == nil || probe.HTTPGet.Path != functionsHostPingPath {
+					t.Errorf("expected the default liveness probe, got %v", probe)
+				}
+			},
+		},
+		{
+			name: "imagePullSecrets removed",
+			before: func(spec *funcv1.AzureFunctionSpec) {
+				spec.ImagePullSecrets = []apiv1.LocalObjectReference{{Name: "registry"}}
+			},
+			check: func(t *testing.T, e *testEnv) {
+				if secrets := e.podSpec().ImagePullSecrets; len(secrets) != 0 {
+					t.Errorf("expected no pull secret, got %v", secrets)
+				}
+			},
+		},
+		{
+			name: "podTemplate removed",
+			before: func(spec *funcv1.AzureFunctionSpec) {
+				spec.PodTemplate = &runtime.RawExtension{Raw: []byte(`{"spec":{"serviceAccountName":"orders"}}`)}
+			},
+			check: func(t *testing.T, e *testEnv) {
+				if account := e.podSpec().ServiceAccountName; account != "" {
+					t.Errorf("expected no service account, got %s", account)
+				}
+			},
+		},
+		{
+			name: "scheduling removed",
+			before: func(spec *funcv1.AzureFunctionSpec) {
+				spec.NodeSelector = map[string]string{"pool": "functions"}
+				spec.Tolerations = []apiv1.Toleration{{Key: "functions", Operator: apiv1.TolerationOpExists}}
+				spec.Affinity = &apiv1.Affinity{PodAntiAffinity: &apiv1.PodAntiAffinity{}}
+				spec.TopologySpreadConstraints = []apiv1.TopologySpreadConstraint{{
+					MaxSkew:           1,
+					TopologyKey:       "topology.kubernetes.io/zone",
+					WhenUnsatisfiable: apiv1.ScheduleAnyway,
+				}}
+			},
+			check: func(t *testing.T, e *testEnv) {
+				spec := e.podSpec()
+				if spec.NodeSelector != nil || spec.Tolerations != nil || spec.Affinity != nil || spec.TopologySpreadConstraints != nil {
+					t.Errorf("expected no scheduling constraint, got %v", spec)
+				}
+			},
+		},
+		{
+			name: "burstPolicy removed",
+			before: func(spec *funcv1.AzureFunctionSpec) {
+				spec.BurstPolicy = funcv1.BurstPolicyVirtualNodes
+			},
+			check: func(t *testing.T, e *testEnv) {
+				_, err := e.kube.AppsV1().Deployments(testNamespace).Get(burstDeploymentName(testName), metav1.GetOptions{})
+				if !errors.IsNotFound(err) {
+					t.Errorf("expected the burst deployment to be deleted, got %v", err)
+				}
+
+				if affinity := e.podSpec().Affinity; affinity != nil {
+					t.Errorf("expected virtual nodes to no longer be excluded, got %v", affinity)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := newTestEnv(t)
+
+			spec := funcv1.AzureFunctionSpec{Image: "functions/orders:1"}
+			if test.before != nil {
+				test.before(&spec)
+			}
+			e.apply(spec)
+
+			spec = funcv1.AzureFunctionSpec{Image: "functions/orders:1"}
+			if test.after != nil {
+				test.after(&spec)
+			}
+			e.apply(spec)
+
+			test.check(t, e)
+		})
+	}
+}
+
+// TestReconcileIsIdempotent checks that reconciling an unchanged function
+// doesn't write anything
+func TestReconcileIsIdempotent(t *testing.T) {
+	e := newTestEnv(t)
+	e.apply(funcv1.AzureFunctionSpec{
+		Image:  "functions/orders:1",
+		Routes: []funcv1.Route{{Path: "/orders"}},
+	})
+
+	e.kube.ClearActions()
+	e.reconcile()
+
+	for _, action := range e.kube.Actions() {
+		if action.GetVerb() != "get" && action.GetVerb() != "list" {
+			t.Errorf("expected no write, got %s %s", action.GetVerb(), action.GetResource().Resource)
+		}
+	}
+}
+
+// TestReconcileAddsComponentPodAnnotations checks that the pods of functions
+// are annotated for the installed components
+func TestReconcileAddsComponentPodAnnotations(t *testing.T) {
+	e := newTestEnv(t)
+	e.handler.MeshComponent = &fakeMeshComponent{}
+
+	e.apply(funcv1.AzureFunctionSpec{Image: "functions/orders:1"})
+
+	annotations := e.deployment(deploymentName(testName)).Spec.Template.Annotations
+	if annotations["sidecar.mesh.example.com/inject"] != "true" {
+		t.Errorf("expected the pods to be annotated for the mesh, got %v", annotations)
+	}
+}
+
+// TestReconcileKeepsRoutesWhileIngressIsDown checks that an ingress component
+// that stops running only shows up on the Routed condition, and that the
+// Ingresses and the ClusterIP Service of the function are left in place
+func TestReconcileKeepsRoutesWhileIngressIsDown(t *testing.T) {
+	e := newTestEnv(t)
+	ingress := &fakeIngressComponent{}
+	e.handler.IngressComponent = ingress
+
+	e.apply(funcv1.AzureFunctionSpec{
+		Image:  "functions/orders:1",
+		Routes: []funcv1.Route{{Path: "/orders"}},
+	})
+
+	for _, down := range []bool{true, false} {
+		ingress.down = down
+		e.reconcile()
+
+		if _, ok := e.ingresses()[routeIngressName(testName, 0)]; !ok {
+			t.Errorf("expected the Ingress to be kept with the ingress component down: %v", down)
+		}
+
+		if serviceType := e.service().Spec.Type; serviceType != apiv1.ServiceTypeClusterIP {
+			t.Errorf("expected a ClusterIP Service with the ingress component down: %v, got %s", down, serviceType)
+		}
+
+		routed := e.function().Status.GetCondition(funcv1.FunctionRouted)
+		if down && (routed == nil || routed.Status != apiv1.ConditionFalse || routed.Reason != reasonIngressUnavailable) {
+			t.Errorf("expected the function to be reported as not routed, got %v", routed)
+		}
+
+		if !down && (routed == nil || routed.Status != apiv1.ConditionTrue) {
+			t.Errorf("expected the function to be routed again, got %v", routed)
+		}
+	}
+}
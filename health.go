@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/yaron2/azfuncs/logging"
+)
+
+// HealthServer serves the liveness and readiness probes of the controller
+type HealthServer struct {
+	Controller *Controller
+	Handler    *AzureFunctionsHandler
+
+	// StallTimeout is how long workers may go without progress while there
+	// is work to do before the controller is considered wedged
+	StallTimeout time.Duration
+
+	leading int32
+}
+
+// SetLeading records whether this replica currently runs the workers
+func (h *HealthServer) SetLeading(leading bool) {
+	value := int32(0)
+	if leading {
+		value = 1
+	}
+
+	atomic.StoreInt32(&h.leading, value)
+}
+
+// Run blocks serving /healthz and /readyz on addr, along with /loglevel to
+// read and change the log level at runtime
+func (h *HealthServer) Run(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.healthz)
+	mux.HandleFunc("/readyz", h.readyz)
+	mux.Handle("/loglevel", logging.LevelHandler())
+
+	log.Infof("HealthServer.Run: listening on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// healthz fails when the workers stopped making progress, for example when
+// a reconcile is stuck, so the kubelet restarts the controller
+func (h *HealthServer) healthz(w http.ResponseWriter, r *http.Request) {
+	if h.Controller.Stalled(h.StallTimeout) {
+		http.Error(w, fmt.Sprintf("workers made no progress for %s", h.StallTimeout), http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprint(w, "ok")
+}
+
+// readyz fails until the caches are synced and while a required ingress or
+// mesh component isn't running. Leadership is reported in the body but
+// doesn't gate readiness: standby replicas sync their caches too and serve
+// the admission webhook behind the same Service, so failing them would
+// leave the webhook with a single endpoint and no warm standby
+func (h *HealthServer) readyz(w http.ResponseWriter, r *http.Request) {
+	if !h.Controller.HasSynced() {
+		http.Error(w, "informer caches not synced", http.StatusServiceUnavailable)
+		return
+	}
+
+	err := h.Handler.ComponentsHealthy()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	role := "standby"
+	if atomic.LoadInt32(&h.leading) == 1 {
+		role = "leader"
+	}
+
+	fmt.Fprintf(w, "ok (%s)", role)
+}
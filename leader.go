@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/yaron2/azfuncs/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const leaseName = "azure-functions-controller"
+
+// runWithLeaderElection blocks until ctx is cancelled, calling run only while
+// this replica holds the lease. The lease is released when ctx is cancelled so
+// a standby can take over without waiting for it to expire
+func runWithLeaderElection(ctx context.Context, client kubernetes.Interface, cfg *config.Config, run func(context.Context)) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      leaseName,
+			Namespace: cfg.Namespace,
+		},
+		Client: client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: cfg.LeaderElection.Identity,
+		},
+	}
+
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   cfg.LeaderElection.LeaseDuration.Duration,
+		RenewDeadline:   cfg.LeaderElection.RenewDeadline.Duration,
+		RetryPeriod:     cfg.LeaderElection.RetryPeriod.Duration,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: run,
+			OnStoppedLeading: func() {
+				// losing the lease without being asked to shut down means
+				// another replica may already be reconciling, so stop at once
+				if ctx.Err() == nil {
+					log.Fatalf("Leader election: lost lease %s/%s", cfg.Namespace, leaseName)
+				}
+
+				log.Infof("Leader election: released lease %s/%s", cfg.Namespace, leaseName)
+			},
+			OnNewLeader: func(identity string) {
+				log.Infof("Leader election: %s is the leader", identity)
+			},
+		},
+	})
+}
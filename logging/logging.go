@@ -0,0 +1,98 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Fields attached to log lines, so all lines about one function, one
+// reconcile or one component can be found together
+const (
+	FieldNamespace   = "namespace"
+	FieldName        = "name"
+	FieldReconcileID = "reconcileID"
+	FieldComponent   = "component"
+)
+
+// Formats supported by Configure
+const (
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+type loggerKey struct{}
+
+// Configure sets the format and the level of the standard logger, which every
+// package of the controller logs through
+func Configure(format string, level string) error {
+	switch strings.ToLower(format) {
+	case FormatJSON:
+		log.SetFormatter(&log.JSONFormatter{})
+	case FormatLogfmt:
+		log.SetFormatter(&log.TextFormatter{DisableColors: true, FullTimestamp: true})
+	default:
+		return fmt.Errorf("unknown log format %q, expected %s or %s", format, FormatJSON, FormatLogfmt)
+	}
+
+	return SetLevel(level)
+}
+
+// SetLevel changes the level of the standard logger, such as "debug" or "info"
+func SetLevel(level string) error {
+	parsed, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	log.SetLevel(parsed)
+	return nil
+}
+
+// WithLogger returns a context carrying logger, for code called with the
+// context to log with the same fields
+func WithLogger(ctx context.Context, logger *log.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext returns the logger carried by ctx, or one without any fields
+func FromContext(ctx context.Context) *log.Entry {
+	logger, ok := ctx.Value(loggerKey{}).(*log.Entry)
+	if !ok {
+		return log.NewEntry(log.StandardLogger())
+	}
+
+	return logger
+}
+
+// LevelHandler returns the current log level on GET and changes it on PUT,
+// taking the new level as the request body
+func LevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			fmt.Fprintln(w, log.GetLevel().String())
+		case http.MethodPut:
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			err = SetLevel(strings.TrimSpace(string(body)))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			log.Infof("Log level set to %s", log.GetLevel().String())
+			fmt.Fprintln(w, log.GetLevel().String())
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -1,29 +1,40 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/workqueue"
 
+	"github.com/yaron2/azfuncs/config"
+	"github.com/yaron2/azfuncs/logging"
+	"github.com/yaron2/azfuncs/metrics"
 	funcv1 "github.com/yaron2/azfuncs/pkg/apis/azurefunctions/v1"
 	azurefunctions "github.com/yaron2/azfuncs/pkg/client/clientset/versioned"
 	azurefunctioninformer_v1 "github.com/yaron2/azfuncs/pkg/client/informers/externalversions/azurefunctions/v1"
+	azurefunctionlister_v1 "github.com/yaron2/azfuncs/pkg/client/listers/azurefunctions/v1"
 	"github.com/yaron2/azfuncs/utils"
+	"github.com/yaron2/azfuncs/webhook"
 )
 
 // retrieve the Kubernetes cluster client from outside of the cluster
 func getClients() (kubernetes.Interface, azurefunctions.Interface) {
 	client := utils.GetKubeClient()
-	config := utils.GetConfig()
+	restConfig := utils.GetConfig()
 
-	azureFuncsClient, err := azurefunctions.NewForConfig(config)
+	azureFuncsClient, err := azurefunctions.NewForConfig(restConfig)
 	if err != nil {
 		log.Fatalf("getClusterConfig: %v", err)
 	}
@@ -34,23 +45,47 @@ func getClients() (kubernetes.Interface, azurefunctions.Interface) {
 
 // main code path
 func main() {
+	// the configuration file is overlaid with the flags given on the
+	// command line, see config.Config for the settings and their defaults
+	flags := config.BindFlags(flag.CommandLine)
+	flag.Parse()
+
+	cfg, err := flags.Load()
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+
+	err = logging.Configure(cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		log.Fatalf("logging: %v", err)
+	}
+
+	configStore := config.NewStore(cfg)
+	utils.SetKubeconfig(cfg.Kubeconfig)
+
 	// get the Kubernetes client for connectivity
 	client, azureFuncsClient := getClients()
 
 	// retrieve our custom resource informer which was generated from
 	// the code generator and pass it the custom resource client, specifying
 	// we should be looking through all namespaces for listing and watching
+	//
+	// every resync period all functions are reconciled again, as a safety net
+	// for changes the watches on owned resources can't see
 	informer := azurefunctioninformer_v1.NewAzureFunctionInformer(
 		azureFuncsClient,
 		meta_v1.NamespaceAll,
-		0,
+		cfg.ResyncPeriod.Duration,
 		cache.Indexers{},
 	)
 
 	// create a new queue so that when the informer gets a resource that is either
 	// a result of listing or watching, we can add an idenfitying key to the queue
 	// so that it can be handled in the handler
-	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	//
+	// the queue never hands the same key to two workers at once, so
+	// functions can be reconciled concurrently without racing each other
+	queue := workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "azurefunctions")
 
 	// add event handlers to handle the three types of events for resources:
 	//  - adding new resources
@@ -70,13 +105,14 @@ func main() {
 		UpdateFunc: func(oldObj, newObj interface{}) {
 			newFunc := newObj.(*funcv1.AzureFunction)
 			oldFunc := oldObj.(*funcv1.AzureFunction)
-			if newFunc.ResourceVersion == oldFunc.ResourceVersion {
-				// Periodic resync will send update events for all known Deployments.
-				// Two different versions of the same Deployment will always have different RVs.
-				return
-			}
 
-			if !apiequality.Semantic.DeepEqual(oldFunc.Spec, newFunc.Spec) {
+			// periodic resync will send update events for all known functions
+			// with an unchanged resource version, these trigger a full reconcile
+			resync := newFunc.ResourceVersion == oldFunc.ResourceVersion
+
+			// a function with a deletion timestamp is waiting for our
+			// finalizer to be removed, so it has to be processed again
+			if resync || newFunc.DeletionTimestamp != nil || !apiequality.Semantic.DeepEqual(oldFunc.Spec, newFunc.Spec) {
 				key, err := cache.MetaNamespaceKeyFunc(newObj)
 				log.Infof("Update Azure Function: %s", key)
 				if err == nil {
@@ -98,38 +134,283 @@ func main() {
 		},
 	})
 
-	ingress := os.Getenv("INGRESS")
-	mesh := os.Getenv("MESH")
+	// the handler, the webhook and the metrics read functions from the
+	// informer cache
+	functionsLister := azurefunctionlister_v1.NewAzureFunctionLister(informer.GetIndexer())
+	metrics.RegisterFunctionsCollector(functionsLister)
+
+	handler := &AzureFunctionsHandler{
+		Ingress:          cfg.Ingress,
+		Mesh:             cfg.Mesh,
+		FunctionsClient:  azureFuncsClient,
+		FunctionsLister:  functionsLister,
+		FunctionsIndexer: informer.GetIndexer(),
+		SharedNamespace:  cfg.SharedNamespace,
+		Config:           configStore,
+		Recorder:         newEventRecorder(client),
+	}
+
+	handler.RegisterComponents()
+
+	// watch the resources created for functions so a function is reconciled
+	// again when one of them drifts or is deleted, and as soon as its service,
+	// or the service of the ingress controller, gets an address
+	//
+	// the informers only list and watch objects labelled as managed by the
+	// controller, and the handler reads them through their listers
+	kubeInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(client, 0,
+		kubeinformers.WithTweakListOptions(func(options *meta_v1.ListOptions) {
+			options.LabelSelector = managedByLabel + "=" + managedByValue
+		}))
+
+	handler.DeploymentsLister = kubeInformerFactory.Apps().V1().Deployments().Lister()
+	handler.AutoscalersLister = kubeInformerFactory.Autoscaling().V2beta2().HorizontalPodAutoscalers().Lister()
+	handler.ServicesLister = kubeInformerFactory.Core().V1().Services().Lister()
+	handler.IngressesLister = kubeInformerFactory.Extensions().V1beta1().Ingresses().Lister()
+	handler.PodsLister = kubeInformerFactory.Core().V1().Pods().Lister()
+
+	ownedInformers := []cache.SharedIndexInformer{
+		kubeInformerFactory.Apps().V1().Deployments().Informer(),
+		kubeInformerFactory.Autoscaling().V2beta2().HorizontalPodAutoscalers().Informer(),
+		kubeInformerFactory.Core().V1().Services().Informer(),
+		kubeInformerFactory.Extensions().V1beta1().Ingresses().Informer(),
+		kubeInformerFactory.Core().V1().Pods().Informer(),
+	}
+
+	// the service of the ingress controller isn't ours, so it is watched by
+	// its own informer restricted to that single service
+	informerFactories := []kubeinformers.SharedInformerFactory{kubeInformerFactory}
+
+	if ingressComponent := handler.ConfiguredIngressComponent(); ingressComponent != nil {
+		ingressInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(client, 0,
+			kubeinformers.WithNamespace(ingressComponent.Namespace()),
+			kubeinformers.WithTweakListOptions(func(options *meta_v1.ListOptions) {
+				options.FieldSelector = "metadata.name=" + ingressComponent.ServiceName()
+			}))
+
+		handler.IngressServiceLister = ingressInformerFactory.Core().V1().Services().Lister()
+		ownedInformers = append(ownedInformers, ingressInformerFactory.Core().V1().Services().Informer())
+		informerFactories = append(informerFactories, ingressInformerFactory)
+	}
+
+	cacheSyncs := []cache.InformerSynced{}
+	for _, ownedInformer := range ownedInformers {
+		ownedInformer.AddEventHandler(handler.OwnedResourceEventHandler(queue))
+		cacheSyncs = append(cacheSyncs, ownedInformer.HasSynced)
+	}
+
+	// the ConfigMaps and Secrets functions take settings from are created by
+	// users, so they are watched without the managed-by selector. Functions
+	// are indexed by the ones they reference, so a change to one of them
+	// enqueues exactly the functions whose pods have to be rolled
+	//
+	// functions are also indexed by their routes, to find the function that
+	// holds a route and to route the next one when it releases it
+	err = informer.AddIndexers(cache.Indexers{
+		cache.NamespaceIndex:  cache.MetaNamespaceIndexFunc,
+		ConfigReferencesIndex: handler.ConfigReferencesIndexFunc,
+		RoutesIndex:           handler.RoutesIndexFunc,
+	})
+	if err != nil {
+		log.Fatalf("AddIndexers: %v", err)
+	}
+
+	informer.AddEventHandler(handler.RouteConflictEventHandler(queue, informer.GetIndexer()))
+
+	// a change to a ConfigMap or Secret enqueues the functions that reference
+	// it, so their pods are rolled
+	configHandler := handler.ConfigReferenceEventHandler(queue, informer.GetIndexer())
+
+	// functions only reference ConfigMaps and Secrets in their own namespace.
+	// With a shared namespace they are all in that namespace. Otherwise only
+	// the namespaces functions run in are watched, each by its own informers
+	// that are started with the first function of the namespace
+	var configNamespaceInformers *namespaceInformers
+	if cfg.SharedNamespace != "" {
+		configInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(client, 0,
+			kubeinformers.WithNamespace(cfg.SharedNamespace))
+		handler.ConfigMapsLister = configInformerFactory.Core().V1().ConfigMaps().Lister()
+		handler.SecretsLister = configInformerFactory.Core().V1().Secrets().Lister()
+		informerFactories = append(informerFactories, configInformerFactory)
+
+		for _, configInformer := range []cache.SharedIndexInformer{
+			configInformerFactory.Core().V1().ConfigMaps().Informer(),
+			configInformerFactory.Core().V1().Secrets().Informer(),
+		} {
+			configInformer.AddEventHandler(configHandler)
+			cacheSyncs = append(cacheSyncs, configInformer.HasSynced)
+		}
+	} else {
+		configNamespaceInformers = newNamespaceInformers(client, informer.GetIndexer(), configHandler)
+		handler.ConfigMapsLister = configNamespaceInformers.ConfigMapLister()
+		handler.SecretsLister = configNamespaceInformers.SecretLister()
+		informer.AddEventHandler(configNamespaceInformers.FunctionEventHandler())
+	}
+
+	// nodes are read for the node port fallback, and the default image pull
+	// secret is copied from the namespace of the controller. Neither is
+	// created by us, and a change to them doesn't enqueue any function
+	nodeInformerFactory := kubeinformers.NewSharedInformerFactory(client, 0)
+	handler.NodesLister = nodeInformerFactory.Core().V1().Nodes().Lister()
+	cacheSyncs = append(cacheSyncs, nodeInformerFactory.Core().V1().Nodes().Informer().HasSynced)
+
+	controllerInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(client, 0,
+		kubeinformers.WithNamespace(cfg.Namespace))
+	handler.ControllerSecretsLister = controllerInformerFactory.Core().V1().Secrets().Lister()
+	cacheSyncs = append(cacheSyncs, controllerInformerFactory.Core().V1().Secrets().Informer().HasSynced)
+
+	informerFactories = append(informerFactories, nodeInformerFactory, controllerInformerFactory)
+
+	// the ingress and mesh components tell whether they are running, and
+	// read the objects they manage for functions, from caches of their own
+	componentInformers := handler.ComponentInformers(client)
+	for _, componentInformer := range componentInformers {
+		cacheSyncs = append(cacheSyncs, componentInformer.HasSynced)
+	}
 
 	// construct the Controller object which has all of the necessary components to
 	// handle logging, connections, informing (listing and watching), the queue,
 	// and the handler
 
 	controller := Controller{
-		logger:    log.NewEntry(log.New()),
-		clientset: client,
-		informer:  informer,
-		queue:     queue,
-		handler: &AzureFunctionsHandler{
-			Ingress:         ingress,
-			Mesh:            mesh,
-			FunctionsClient: azureFuncsClient,
-		},
+		logger:     log.NewEntry(log.StandardLogger()),
+		clientset:  client,
+		informer:   informer,
+		cacheSyncs: cacheSyncs,
+		queue:      queue,
+		workers:    cfg.Workers,
+		handler:    handler,
 	}
 
-	controller.handler.Init()
+	// optionally serve the admission webhook from the same binary, sharing
+	// the informer cache so ingress route uniqueness can be checked without
+	// listing functions from the API server on every admission request
+	if cfg.Webhook.Enabled() {
+		webhookServer := &webhook.Server{
+			Port:     cfg.Webhook.Port,
+			CertFile: cfg.Webhook.CertFile,
+			KeyFile:  cfg.Webhook.KeyFile,
+			Lister:   functionsLister,
+		}
+
+		go func() {
+			log.Fatalf("webhook: %v", webhookServer.Run())
+		}()
+	}
+
+	// serve the controller metrics, including work queue depth and worker
+	// utilisation
+	go func() {
+		log.Fatalf("metrics: %v", metrics.Serve(cfg.MetricsAddr))
+	}()
+
+	// cancelling the context stops the informer, the workers and, when leader
+	// election is enabled, releases the lease for a graceful shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// run the informer to start listing and watching resources on every
+	// replica, so a standby has a warm cache when it becomes the leader
+	go informer.Run(ctx.Done())
+	for _, informerFactory := range informerFactories {
+		informerFactory.Start(ctx.Done())
+	}
 
-	// use a channel to synchronize the finalization for a graceful shutdown
-	stopCh := make(chan struct{})
-	defer close(stopCh)
+	for _, componentInformer := range componentInformers {
+		go componentInformer.Run(ctx.Done())
+	}
 
-	// run the controller loop to process items
-	go controller.Run(stopCh)
+	if configNamespaceInformers != nil {
+		configNamespaceInformers.Start(ctx.Done())
+	}
 
 	// use a channel to handle OS signals to terminate and gracefully shut
 	// down processing
 	sigTerm := make(chan os.Signal, 1)
 	signal.Notify(sigTerm, syscall.SIGTERM)
 	signal.Notify(sigTerm, syscall.SIGINT)
-	<-sigTerm
+
+	go func() {
+		<-sigTerm
+		log.Info("Shutting down")
+		cancel()
+	}()
+
+	// on SIGHUP the configuration is read again. Only the settings that are
+	// safe to change while running are applied, the others need a restart
+	sigHup := make(chan os.Signal, 1)
+	signal.Notify(sigHup, syscall.SIGHUP)
+
+	go func() {
+		for range sigHup {
+			reloadConfig(flags, configStore)
+		}
+	}()
+
+	healthServer := &HealthServer{
+		Controller:   &controller,
+		Handler:      handler,
+		StallTimeout: cfg.StallTimeout.Duration,
+	}
+
+	go func() {
+		log.Fatalf("health: %v", healthServer.Run(cfg.HealthAddr))
+	}()
+
+	// only the leader installs components and reconciles functions, so
+	// replicas never race on creating the same resources
+	run := func(ctx context.Context) {
+		log.Info("Leader election: started leading, running workers")
+		metrics.Leader.Set(1)
+		defer metrics.Leader.Set(0)
+		healthServer.SetLeading(true)
+		defer healthServer.SetLeading(false)
+
+		// the components tell whether they have to be installed from their
+		// caches, which are empty until synced
+		if !cache.WaitForCacheSync(ctx.Done(), controller.HasSynced) {
+			return
+		}
+
+		err := controller.handler.Init()
+		if err != nil {
+			log.Errorf("AzureFunctionsHandler.Init: %v", err)
+		}
+
+		go wait.Until(handler.ReportComponentHealth, 30*time.Second, ctx.Done())
+
+		controller.Run(ctx)
+	}
+
+	if cfg.LeaderElection.Enabled {
+		runWithLeaderElection(ctx, client, cfg, run)
+	} else {
+		run(ctx)
+	}
+}
+
+// reloadConfig reads the configuration again and applies it. An invalid
+// configuration is logged and the current one is kept
+func reloadConfig(flags *config.Flags, store *config.Store) {
+	cfg, err := flags.Load()
+	if err != nil {
+		log.Errorf("reloadConfig: keeping the current configuration: %v", err)
+		return
+	}
+
+	restartRequired := store.Get().RestartRequired(cfg)
+	if len(restartRequired) > 0 {
+		log.Warnf("reloadConfig: changes to %s take effect on restart", strings.Join(restartRequired, ", "))
+	}
+
+	err = logging.Configure(cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		log.Errorf("reloadConfig: keeping the current configuration: %v", err)
+		return
+	}
+
+	// the handler reads the reloadable settings from the store on every
+	// reconcile, so they apply as functions are reconciled
+	store.Set(store.Get().Reload(cfg))
+	log.Info("reloadConfig: configuration reloaded")
 }
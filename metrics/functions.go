@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/labels"
+
+	funcv1 "github.com/yaron2/azfuncs/pkg/apis/azurefunctions/v1"
+	listers "github.com/yaron2/azfuncs/pkg/client/listers/azurefunctions/v1"
+)
+
+var functionsDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "", "functions"),
+	"Number of functions by access policy and readiness.",
+	[]string{"access_policy", "ready"},
+	nil,
+)
+
+// functionsCollector counts the functions in the informer cache on every
+// scrape, so the gauge can't drift from the actual set of functions
+type functionsCollector struct {
+	lister listers.AzureFunctionLister
+}
+
+// RegisterFunctionsCollector exports the functions gauge, read from lister
+func RegisterFunctionsCollector(lister listers.AzureFunctionLister) {
+	prometheus.MustRegister(&functionsCollector{lister: lister})
+}
+
+func (c *functionsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- functionsDesc
+}
+
+func (c *functionsCollector) Collect(ch chan<- prometheus.Metric) {
+	functions, err := c.lister.List(labels.Everything())
+	if err != nil {
+		return
+	}
+
+	type key struct {
+		accessPolicy string
+		ready        string
+	}
+
+	counts := map[key]int{}
+	for _, function := range functions {
+		ready := "false"
+		if function.Status.IsConditionTrue(funcv1.FunctionReady) {
+			ready = "true"
+		}
+
+		counts[key{accessPolicy: function.Spec.AccessPolicy, ready: ready}]++
+	}
+
+	for k, count := range counts {
+		ch <- prometheus.MustNewConstMetric(functionsDesc, prometheus.GaugeValue, float64(count), k.accessPolicy, k.ready)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	funcv1 "github.com/yaron2/azfuncs/pkg/apis/azurefunctions/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// namespaceInformers watches the ConfigMaps and Secrets of the namespaces
+// functions run in, instead of the ones of every namespace of the cluster.
+// The informers of a namespace are started when a function is added to it
+// and stopped once its last function is deleted
+type namespaceInformers struct {
+	client    kubernetes.Interface
+	functions cache.Indexer
+	handler   cache.ResourceEventHandler
+
+	lock       sync.Mutex
+	stop       <-chan struct{}
+	namespaces map[string]*namespaceInformer
+}
+
+type namespaceInformer struct {
+	factory    kubeinformers.SharedInformerFactory
+	configMaps cache.SharedIndexInformer
+	secrets    cache.SharedIndexInformer
+	stop       chan struct{}
+}
+
+// newNamespaceInformers returns the informers for the namespaces of the
+// functions in the functions indexer, which needs a cache.NamespaceIndex.
+// handler gets the events of the ConfigMaps and Secrets of every namespace
+func newNamespaceInformers(client kubernetes.Interface, functions cache.Indexer, handler cache.ResourceEventHandler) *namespaceInformers {
+	return &namespaceInformers{
+		client:     client,
+		functions:  functions,
+		handler:    handler,
+		namespaces: map[string]*namespaceInformer{},
+	}
+}
+
+// Start runs the informers of the namespaces added so far, and of the ones
+// added later on, until stop is closed
+func (n *namespaceInformers) Start(stop <-chan struct{}) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.stop = stop
+	for _, informer := range n.namespaces {
+		informer.factory.Start(informer.stop)
+	}
+
+	go func() {
+		<-stop
+
+		n.lock.Lock()
+		defer n.lock.Unlock()
+
+		for namespace, informer := range n.namespaces {
+			close(informer.stop)
+			delete(n.namespaces, namespace)
+		}
+	}()
+}
+
+// add returns the informers of a namespace, creating them if they don't
+// exist yet
+func (n *namespaceInformers) add(namespace string) *namespaceInformer {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	informer, ok := n.namespaces[namespace]
+	if ok {
+		return informer
+	}
+
+	factory := kubeinformers.NewSharedInformerFactoryWithOptions(n.client, 0, kubeinformers.WithNamespace(namespace))
+	informer = &namespaceInformer{
+		factory:    factory,
+		configMaps: factory.Core().V1().ConfigMaps().Informer(),
+		secrets:    factory.Core().V1().Secrets().Informer(),
+		stop:       make(chan struct{}),
+	}
+
+	informer.configMaps.AddEventHandler(n.handler)
+	informer.secrets.AddEventHandler(n.handler)
+
+	if n.stop != nil {
+		factory.Start(informer.stop)
+	}
+
+	n.namespaces[namespace] = informer
+	return informer
+}
+
+// remove stops the informers of a namespace no function is left in
+func (n *namespaceInformers) remove(namespace string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	functions, err := n.functions.ByIndex(cache.NamespaceIndex, namespace)
+	if err != nil || len(functions) > 0 {
+		return
+	}
+
+	informer, ok := n.namespaces[namespace]
+	if !ok {
+		return
+	}
+
+	close(informer.stop)
+	delete(n.namespaces, namespace)
+}
+
+// synced returns the informers of a namespace once their caches are synced.
+// A function can be reconciled before its add event reached us, so the
+// informers are added here as well
+func (n *namespaceInformers) synced(namespace string) (*namespaceInformer, error) {
+	informer := n.add(namespace)
+
+	if !cache.WaitForCacheSync(informer.stop, informer.configMaps.HasSynced, informer.secrets.HasSynced) {
+		return nil, fmt.Errorf("informers of namespace %s were stopped before they synced", namespace)
+	}
+
+	return informer, nil
+}
+
+// FunctionEventHandler adds and removes the namespaces to watch as functions
+// are added and deleted
+func (n *namespaceInformers) FunctionEventHandler() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if function, ok := obj.(*funcv1.AzureFunction); ok {
+				n.add(function.Namespace)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+
+			if function, ok := obj.(*funcv1.AzureFunction); ok {
+				n.remove(function.Namespace)
+			}
+		},
+	}
+}
+
+// list returns the informers of every watched namespace
+func (n *namespaceInformers) list() []*namespaceInformer {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	informers := []*namespaceInformer{}
+	for _, informer := range n.namespaces {
+		informers = append(informers, informer)
+	}
+
+	return informers
+}
+
+// ConfigMapLister reads ConfigMaps from the informers of their namespace
+func (n *namespaceInformers) ConfigMapLister() corelisters.ConfigMapLister {
+	return namespaceConfigMapLister{informers: n}
+}
+
+// SecretLister reads Secrets from the informers of their namespace
+func (n *namespaceInformers) SecretLister() corelisters.SecretLister {
+	return namespaceSecretLister{informers: n}
+}
+
+type namespaceConfigMapLister struct {
+	informers *namespaceInformers
+	namespace string
+}
+
+// List lists the ConfigMaps of the namespace of the lister, or of every watched
+// namespace when it has none
+func (l namespaceConfigMapLister) List(selector labels.Selector) ([]*apiv1.ConfigMap, error) {
+	if l.namespace != "" {
+		lister, err := l.lister()
+		if err != nil {
+			return nil, err
+		}
+
+		return lister.List(selector)
+	}
+
+	configMaps := []*apiv1.ConfigMap{}
+	for _, informer := range l.informers.list() {
+		listed, err := corelisters.NewConfigMapLister(informer.configMaps.GetIndexer()).List(selector)
+		if err != nil {
+			return nil, err
+		}
+
+		configMaps = append(configMaps, listed...)
+	}
+
+	return configMaps, nil
+}
+
+func (l namespaceConfigMapLister) ConfigMaps(namespace string) corelisters.ConfigMapNamespaceLister {
+	return namespaceConfigMapLister{informers: l.informers, namespace: namespace}
+}
+
+func (l namespaceConfigMapLister) lister() (corelisters.ConfigMapNamespaceLister, error) {
+	informer, err := l.informers.synced(l.namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	return corelisters.NewConfigMapLister(informer.configMaps.GetIndexer()).ConfigMaps(l.namespace), nil
+}
+
+func (l namespaceConfigMapLister) Get(name string) (*apiv1.ConfigMap, error) {
+	lister, err := l.lister()
+	if err != nil {
+		return nil, err
+	}
+
+	return lister.Get(name)
+}
+
+type namespaceSecretLister struct {
+	informers *namespaceInformers
+	namespace string
+}
+
+// List lists the Secrets of the namespace of the lister, or of every watched
+// namespace when it has none
+func (l namespaceSecretLister) List(selector labels.Selector) ([]*apiv1.Secret, error) {
+	if l.namespace != "" {
+		lister, err := l.lister()
+		if err != nil {
+			return nil, err
+		}
+
+		return lister.List(selector)
+	}
+
+	secrets := []*apiv1.Secret{}
+	for _, informer := range l.informers.list() {
+		listed, err := corelisters.NewSecretLister(informer.secrets.GetIndexer()).List(selector)
+		if err != nil {
+			return nil, err
+		}
+
+		secrets = append(secrets, listed...)
+	}
+
+	return secrets, nil
+}
+
+func (l namespaceSecretLister) Secrets(namespace string) corelisters.SecretNamespaceLister {
+	return namespaceSecretLister{informers: l.informers, namespace: namespace}
+}
+
+func (l namespaceSecretLister) lister() (corelisters.SecretNamespaceLister, error) {
+	informer, err := l.informers.synced(l.namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	return corelisters.NewSecretLister(informer.secrets.GetIndexer()).Secrets(l.namespace), nil
+}
+
+func (l namespaceSecretLister) Get(name string) (*apiv1.Secret, error) {
+	lister, err := l.lister()
+	if err != nil {
+		return nil, err
+	}
+
+	return lister.Get(name)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	funcv1 "github.com/yaron2/azfuncs/pkg/apis/azurefunctions/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+// TestNamespaceInformersOnlyWatchFunctionNamespaces checks that ConfigMaps
+// and Secrets are only cached for the namespaces functions run in, and that
+// a namespace stops being watched with its last function
+func TestNamespaceInformersOnlyWatchFunctionNamespaces(t *testing.T) {
+	client := kubefake.NewSimpleClientset(
+		&apiv1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "settings", Namespace: testNamespace}},
+		&apiv1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "settings", Namespace: "other"}},
+		&apiv1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "credentials", Namespace: testNamespace}},
+	)
+
+	functions := newIndexer(cache.Indexers{})
+	function := &funcv1.AzureFunction{
+		ObjectMeta: metav1.ObjectMeta{Name: testName, Namespace: testNamespace},
+	}
+
+	if err := functions.Add(function); err != nil {
+		t.Fatal(err)
+	}
+
+	informers := newNamespaceInformers(client, functions, cache.ResourceEventHandlerFuncs{})
+	handler := informers.FunctionEventHandler()
+	handler.OnAdd(function)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	informers.Start(stop)
+
+	configMaps := informers.ConfigMapLister()
+	secrets := informers.SecretLister()
+
+	if _, err := configMaps.ConfigMaps(testNamespace).Get("settings"); err != nil {
+		t.Errorf("expected the ConfigMap of the function namespace to be cached: %v", err)
+	}
+
+	if _, err := secrets.Secrets(testNamespace).Get("credentials"); err != nil {
+		t.Errorf("expected the Secret of the function namespace to be cached: %v", err)
+	}
+
+	listed, err := configMaps.List(labels.Everything())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(listed) != 1 || listed[0].Namespace != testNamespace {
+		t.Errorf("expected only the namespace of the function to be watched, got %v", listed)
+	}
+
+	if err := functions.Delete(function); err != nil {
+		t.Fatal(err)
+	}
+
+	handler.OnDelete(function)
+
+	if watched := informers.list(); len(watched) != 0 {
+		t.Errorf("expected no namespace to be watched without functions, got %d", len(watched))
+	}
+}
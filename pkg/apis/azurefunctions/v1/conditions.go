@@ -0,0 +1,47 @@
+package v1
+
+import (
+	core_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// GetCondition returns the condition of the given type, or nil if it is not set
+func (s *AzureFunctionStatus) GetCondition(conditionType AzureFunctionConditionType) *AzureFunctionCondition {
+	for i := range s.Conditions {
+		if s.Conditions[i].Type == conditionType {
+			return &s.Conditions[i]
+		}
+	}
+
+	return nil
+}
+
+// SetCondition adds or updates a condition. LastTransitionTime only moves
+// when the status of the condition actually changes
+func (s *AzureFunctionStatus) SetCondition(conditionType AzureFunctionConditionType, status core_v1.ConditionStatus, reason string, message string) {
+	existing := s.GetCondition(conditionType)
+	if existing == nil {
+		s.Conditions = append(s.Conditions, AzureFunctionCondition{
+			Type:               conditionType,
+			Status:             status,
+			LastTransitionTime: meta_v1.Now(),
+			Reason:             reason,
+			Message:            message,
+		})
+		return
+	}
+
+	if existing.Status != status {
+		existing.LastTransitionTime = meta_v1.Now()
+	}
+
+	existing.Status = status
+	existing.Reason = reason
+	existing.Message = message
+}
+
+// IsConditionTrue reports whether the condition of the given type is set to True
+func (s *AzureFunctionStatus) IsConditionTrue(conditionType AzureFunctionConditionType) bool {
+	condition := s.GetCondition(conditionType)
+	return condition != nil && condition.Status == core_v1.ConditionTrue
+}
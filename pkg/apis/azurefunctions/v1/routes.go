@@ -0,0 +1,48 @@
+package v1
+
+import "strings"
+
+// IngressRoutes returns the routes of the function: ingressRoute, when set,
+// as a prefix route on any host, followed by routes with their path type
+// defaulted
+func (s *AzureFunctionSpec) IngressRoutes() []Route {
+	routes := []Route{}
+
+	if s.IngressRoute != "" {
+		routes = append(routes, Route{Path: s.IngressRoute, PathType: PathTypePrefix})
+	}
+
+	for _, route := range s.Routes {
+		if route.PathType == "" {
+			route.PathType = PathTypePrefix
+		}
+
+		routes = append(routes, route)
+	}
+
+	return routes
+}
+
+// Key identifies a route by its host, path type and path, regardless of its
+// methods
+func (r Route) Key() string {
+	return r.Host + "|" + r.PathType + "|" + r.Path
+}
+
+// Overlaps reports whether two routes compete for the same requests. Every
+// route is served by an nginx location on its path, and the location with the
+// longest matching path wins. Routes on the same host and path overlap
+// whatever their path type, and an exact route overlaps a prefix route it is
+// below, since its location takes the requests below its path away from the
+// prefix route
+func (r Route) Overlaps(other Route) bool {
+	if r.Host != other.Host {
+		return false
+	}
+
+	return r.Path == other.Path || r.shadows(other) || other.shadows(r)
+}
+
+func (r Route) shadows(prefix Route) bool {
+	return r.PathType == PathTypeExact && prefix.PathType == PathTypePrefix && strings.HasPrefix(r.Path, prefix.Path)
+}
@@ -0,0 +1,19 @@
+package v1
+
+// MinReplicas returns scale.min when it is set, or the top-level min
+func (s *AzureFunctionSpec) MinReplicas() *int32 {
+	if s.Scale != nil && s.Scale.Min != nil {
+		return s.Scale.Min
+	}
+
+	return s.Min
+}
+
+// MaxReplicas returns scale.max when it is set, or the top-level max
+func (s *AzureFunctionSpec) MaxReplicas() *int32 {
+	if s.Scale != nil && s.Scale.Max != nil {
+		return s.Scale.Max
+	}
+
+	return s.Max
+}
@@ -1,26 +1,287 @@
 package v1
 
 import (
+	core_v1 "k8s.io/api/core/v1"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 // +genclient
-// +genclient:noStatus
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+// +kubebuilder:resource:scope=Namespaced,shortName=azfunc
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="URL",type=string,JSONPath=`.status.url`
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 type AzureFunction struct {
 	meta_v1.TypeMeta   `json:",inline"`
 	meta_v1.ObjectMeta `json:"metadata,omitempty"`
-	Spec               AzureFunctionSpec `json:"spec"`
+	Spec               AzureFunctionSpec   `json:"spec"`
+	Status             AzureFunctionStatus `json:"status,omitempty"`
 }
 
+// AzureFunctionSpec is validated and defaulted by the API server using the
+// schema generated from the markers below, see codegen.sh
 type AzureFunctionSpec struct {
-	Image        string `json:"image"`
-	AccessPolicy string `json:"accessPolicy"`
-	Min          *int32 `json:"min"`
-	Max          *int32 `json:"max"`
-	IngressRoute string `json:"ingressRoute"`
-	URL          string `json: "url"`
+	// +kubebuilder:validation:MinLength=1
+	Image string `json:"image"`
+
+	// +optional
+	// +kubebuilder:validation:Enum=public;private
+	// +kubebuilder:default=public
+	AccessPolicy string `json:"accessPolicy,omitempty"`
+
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=1000
+	// +kubebuilder:default=1
+	Min *int32 `json:"min,omitempty"`
+
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=1000
+	// +kubebuilder:default=1000
+	Max *int32 `json:"max,omitempty"`
+
+	// +optional
+	// +kubebuilder:validation:Pattern=`^/`
+	IngressRoute string `json:"ingressRoute,omitempty"`
+
+	// AppSettings are the settings of the Functions host by name, such as
+	// AzureWebJobsStorage or FUNCTIONS_WORKER_RUNTIME
+	// +optional
+	AppSettings map[string]AppSetting `json:"appSettings,omitempty"`
+
+	// Env is added to the function container after the app settings, so a
+	// variable set in both takes its value from Env
+	// +optional
+	Env []core_v1.EnvVar `json:"env,omitempty"`
+
+	// +optional
+	EnvFrom []core_v1.EnvFromSource `json:"envFrom,omitempty"`
+
+	// Resources are the requests and limits of the function container. The
+	// autoscaler needs requests to compute utilization
+	// +optional
+	Resources core_v1.ResourceRequirements `json:"resources,omitempty"`
+
+	// +optional
+	Scale *ScaleSpec `json:"scale,omitempty"`
+
+	// +optional
+	Probes *ProbesSpec `json:"probes,omitempty"`
+
+	// Port the function container listens on
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +kubebuilder:default=80
+	Port *int32 `json:"port,omitempty"`
+
+	// Protocol served on Port. The ingress and mesh are configured to match
+	// +optional
+	// +kubebuilder:validation:Enum=http;http2;grpc
+	// +kubebuilder:default=http
+	Protocol string `json:"protocol,omitempty"`
+
+	// Ports are additional ports of the function container, exposed on its
+	// service under the same name
+	// +optional
+	Ports []FunctionPort `json:"ports,omitempty"`
+
+	// ImagePullSecrets name Secrets in the namespace of the function used to
+	// pull its image, in addition to the default secret of the controller
+	// +optional
+	ImagePullSecrets []core_v1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+
+	// PodTemplate is a partial PodTemplateSpec merged onto the generated pod
+	// template with strategic-merge semantics, to add volumes, sidecars or
+	// init containers. The image and ports of the function container and
+	// the labels set by the controller can't be overridden
+	// +optional
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +kubebuilder:validation:Type=object
+	PodTemplate *runtime.RawExtension `json:"podTemplate,omitempty"`
+
+	// NodeSelector, Affinity, Tolerations and TopologySpreadConstraints
+	// schedule the pods of the function. Each of them replaces the default
+	// profile of the controller when set
+	// +optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// +optional
+	Affinity *core_v1.Affinity `json:"affinity,omitempty"`
+	// +optional
+	Tolerations []core_v1.Toleration `json:"tolerations,omitempty"`
+	// +optional
+	TopologySpreadConstraints []core_v1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+
+	// BurstPolicy VirtualNodes keeps the pods of the function on real nodes,
+	// and runs the replicas that don't fit there on virtual-kubelet nodes
+	// +optional
+	// +kubebuilder:validation:Enum=None;VirtualNodes
+	// +kubebuilder:default=None
+	BurstPolicy string `json:"burstPolicy,omitempty"`
+
+	// Routes expose paths of the function through the ingress, in addition
+	// to IngressRoute. Unlike IngressRoute, their paths are passed to the
+	// function unchanged
+	// +optional
+	Routes []Route `json:"routes,omitempty"`
+}
+
+// Route matches requests to a function by host, path and HTTP method
+type Route struct {
+	// Host restricts the route to a hostname. Any host matches when empty
+	// +optional
+	Host string `json:"host,omitempty"`
+
+	// Path must not contain quotes, braces, $ or whitespace, since it is
+	// written into the nginx configuration
+	// +kubebuilder:validation:Pattern=`^/[A-Za-z0-9/._~%!&'()*+,;=:@-]*$`
+	Path string `json:"path"`
+
+	// PathType is Prefix, matching the path and everything below it, or
+	// Exact
+	// +optional
+	// +kubebuilder:validation:Enum=Prefix;Exact
+	// +kubebuilder:default=Prefix
+	PathType string `json:"pathType,omitempty"`
+
+	// Methods only lets requests with one of these HTTP methods through.
+	// Every method is let through when empty
+	// +optional
+	Methods []HTTPMethod `json:"methods,omitempty"`
+}
+
+// HTTPMethod is a method a route can be restricted to. Methods are written
+// into the nginx configuration, so only these are accepted
+// +kubebuilder:validation:Enum=GET;HEAD;POST;PUT;PATCH;DELETE;OPTIONS
+type HTTPMethod string
+
+const (
+	PathTypePrefix = "Prefix"
+	PathTypeExact  = "Exact"
+)
+
+const (
+	BurstPolicyNone         = "None"
+	BurstPolicyVirtualNodes = "VirtualNodes"
+)
+
+const (
+	ProtocolHTTP  = "http"
+	ProtocolHTTP2 = "http2"
+	ProtocolGRPC  = "grpc"
+)
+
+// FunctionPort is an additional named port of the function container
+type FunctionPort struct {
+	// Name of the port. Prefixing it with the protocol, such as grpc-admin,
+	// lets service meshes detect the protocol
+	// +kubebuilder:validation:MaxLength=15
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Name string `json:"name"`
+
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Port int32 `json:"port"`
+}
+
+// ProbesSpec overrides the probes of the function container. Probes that are
+// left out default to probing the health endpoint of the Functions host
+type ProbesSpec struct {
+	// +optional
+	Liveness *core_v1.Probe `json:"liveness,omitempty"`
+
+	// +optional
+	Readiness *core_v1.Probe `json:"readiness,omitempty"`
+
+	// Startup holds off the liveness probe while the Functions host loads
+	// +optional
+	Startup *core_v1.Probe `json:"startup,omitempty"`
+}
+
+// ScaleSpec controls the autoscaler of a function. Min and Max take
+// precedence over the top-level min and max of the spec
+type ScaleSpec struct {
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=1000
+	Min *int32 `json:"min,omitempty"`
+
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=1000
+	Max *int32 `json:"max,omitempty"`
+
+	// TargetCPUUtilizationPercentage of the CPU requests. Defaults to the
+	// target of the controller configuration
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	TargetCPUUtilizationPercentage *int32 `json:"targetCPUUtilizationPercentage,omitempty"`
+
+	// TargetMemoryUtilizationPercentage of the memory requests. Memory is
+	// only scaled on when it is set
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	TargetMemoryUtilizationPercentage *int32 `json:"targetMemoryUtilizationPercentage,omitempty"`
+}
+
+// AppSetting is either a literal value or a key of a ConfigMap or Secret in
+// the namespace the function runs in
+type AppSetting struct {
+	// +optional
+	Value string `json:"value,omitempty"`
+
+	// +optional
+	ConfigMapKeyRef *core_v1.ConfigMapKeySelector `json:"configMapKeyRef,omitempty"`
+
+	// +optional
+	SecretKeyRef *core_v1.SecretKeySelector `json:"secretKeyRef,omitempty"`
+}
+
+const (
+	AccessPolicyPublic  = "public"
+	AccessPolicyPrivate = "private"
+)
+
+// AzureFunctionStatus is written by the controller through the status
+// subresource and is never set by users
+type AzureFunctionStatus struct {
+	URL                string                   `json:"url,omitempty"`
+	ObservedGeneration int64                    `json:"observedGeneration,omitempty"`
+	ReadyReplicas      int32                    `json:"readyReplicas,omitempty"`
+	Conditions         []AzureFunctionCondition `json:"conditions,omitempty"`
+}
+
+type AzureFunctionConditionType string
+
+const (
+	// FunctionReady means the function has a URL and at least one ready replica
+	FunctionReady AzureFunctionConditionType = "Ready"
+	// FunctionRouted means the ingress route for the function is in place
+	FunctionRouted AzureFunctionConditionType = "Routed"
+	// FunctionScaled means the autoscaler for the function is in place
+	FunctionScaled AzureFunctionConditionType = "Scaled"
+	// FunctionPending is set while the function waits for an address
+	FunctionPending AzureFunctionConditionType = "Pending"
+	// FunctionCleanedUp is set to False while a deleted function still has
+	// resources that couldn't be removed
+	FunctionCleanedUp AzureFunctionConditionType = "CleanedUp"
+	// FunctionImagePulled is set to False while the image of the function
+	// can't be pulled, such as on ErrImagePull
+	FunctionImagePulled AzureFunctionConditionType = "ImagePulled"
+)
+
+type AzureFunctionCondition struct {
+	Type               AzureFunctionConditionType `json:"type"`
+	Status             core_v1.ConditionStatus    `json:"status"`
+	LastTransitionTime meta_v1.Time               `json:"lastTransitionTime,omitempty"`
+	Reason             string                     `json:"reason,omitempty"`
+	Message            string                     `json:"message,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
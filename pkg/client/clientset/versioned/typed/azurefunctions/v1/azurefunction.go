@@ -37,6 +37,7 @@ type AzureFunctionsGetter interface {
 type AzureFunctionInterface interface {
 	Create(*v1.AzureFunction) (*v1.AzureFunction, error)
 	Update(*v1.AzureFunction) (*v1.AzureFunction, error)
+	UpdateStatus(*v1.AzureFunction) (*v1.AzureFunction, error)
 	Delete(name string, options *metav1.DeleteOptions) error
 	DeleteCollection(options *metav1.DeleteOptions, listOptions metav1.ListOptions) error
 	Get(name string, options metav1.GetOptions) (*v1.AzureFunction, error)
@@ -120,6 +121,22 @@ func (c *azureFunctions) Update(azureFunction *v1.AzureFunction) (result *v1.Azu
 	return
 }
 
+// UpdateStatus was generated because the type contains a Status member.
+// Add a +genclient:noStatus comment above the type to avoid generating UpdateStatus().
+
+func (c *azureFunctions) UpdateStatus(azureFunction *v1.AzureFunction) (result *v1.AzureFunction, err error) {
+	result = &v1.AzureFunction{}
+	err = c.client.Put().
+		Namespace(c.ns).
+		Resource("azurefunctions").
+		Name(azureFunction.Name).
+		SubResource("status").
+		Body(azureFunction).
+		Do().
+		Into(result)
+	return
+}
+
 // Delete takes name of the azureFunction and deletes it. Returns an error if one occurs.
 func (c *azureFunctions) Delete(name string, options *metav1.DeleteOptions) error {
 	return c.client.Delete().
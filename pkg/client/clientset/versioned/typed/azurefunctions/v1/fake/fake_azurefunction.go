@@ -100,6 +100,18 @@ func (c *FakeAzureFunctions) Update(azureFunction *azurefunctionsv1.AzureFunctio
 	return obj.(*azurefunctionsv1.AzureFunction), err
 }
 
+// UpdateStatus was generated because the type contains a Status member.
+// Add a +genclient:noStatus comment above the type to avoid generating UpdateStatus().
+func (c *FakeAzureFunctions) UpdateStatus(azureFunction *azurefunctionsv1.AzureFunction) (*azurefunctionsv1.AzureFunction, error) {
+	obj, err := c.Fake.
+		Invokes(testing.NewUpdateSubresourceAction(azurefunctionsResource, "status", c.ns, azureFunction), &azurefunctionsv1.AzureFunction{})
+
+	if obj == nil {
+		return nil, err
+	}
+	return obj.(*azurefunctionsv1.AzureFunction), err
+}
+
 // Delete takes name of the azureFunction and deletes it. Returns an error if one occurs.
 func (c *FakeAzureFunctions) Delete(name string, options *v1.DeleteOptions) error {
 	_, err := c.Fake.
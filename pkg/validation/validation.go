@@ -0,0 +1,313 @@
+// Package validation holds the AzureFunction rules that can't be expressed in
+// the CRD schema. It has no dependencies on the controller so the admission
+// webhook and the CLI can share it.
+package validation
+
+import (
+	"encoding/json"
+	"regexp"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	funcv1 "github.com/yaron2/azfuncs/pkg/apis/azurefunctions/v1"
+)
+
+const (
+	DefaultMinReplicas int32 = 1
+	DefaultMaxReplicas int32 = 1000
+	DefaultPort        int32 = 80
+)
+
+// SetDefaults fills in the same defaults as the CRD schema, for objects
+// that are created before the schema was installed or outside of a cluster
+func SetDefaults(function *funcv1.AzureFunction) {
+	if function.Spec.AccessPolicy == "" {
+		function.Spec.AccessPolicy = funcv1.AccessPolicyPublic
+	}
+
+	if function.Spec.Min == nil {
+		min := DefaultMinReplicas
+		function.Spec.Min = &min
+	}
+
+	if function.Spec.Max == nil {
+		max := DefaultMaxReplicas
+		function.Spec.Max = &max
+	}
+
+	if function.Spec.Port == nil {
+		port := DefaultPort
+		function.Spec.Port = &port
+	}
+
+	if function.Spec.Protocol == "" {
+		function.Spec.Protocol = funcv1.ProtocolHTTP
+	}
+
+	if function.Spec.BurstPolicy == "" {
+		function.Spec.BurstPolicy = funcv1.BurstPolicyNone
+	}
+}
+
+// ValidateAzureFunction checks a single function in isolation
+func ValidateAzureFunction(function *funcv1.AzureFunction) field.ErrorList {
+	allErrs := field.ErrorList{}
+	specPath := field.NewPath("spec")
+
+	if function.Spec.Image == "" {
+		allErrs = append(allErrs, field.Required(specPath.Child("image"), "an image must be set"))
+	}
+
+	// scale.min and scale.max override the top-level fields, so the pair
+	// that is actually used is checked
+	min, max := function.Spec.MinReplicas(), function.Spec.MaxReplicas()
+	if min != nil && max != nil && *min > *max {
+		minPath := specPath.Child("min")
+		if function.Spec.Scale != nil && function.Spec.Scale.Min != nil {
+			minPath = specPath.Child("scale", "min")
+		}
+
+		allErrs = append(allErrs, field.Invalid(minPath, *min, "must be less than or equal to max"))
+	}
+
+	if function.Spec.AccessPolicy == funcv1.AccessPolicyPrivate && function.Spec.IngressRoute != "" {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("ingressRoute"), "private access policy can't be combined with an ingress route"))
+	}
+
+	if function.Spec.AccessPolicy == funcv1.AccessPolicyPrivate && len(function.Spec.Routes) > 0 {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("routes"), "private access policy can't be combined with routes"))
+	}
+
+	allErrs = append(allErrs, validateRoutes(function, specPath)...)
+
+	allErrs = append(allErrs, validatePorts(function, specPath)...)
+	allErrs = append(allErrs, validatePodTemplate(function, specPath.Child("podTemplate"))...)
+
+	for name, setting := range function.Spec.AppSettings {
+		allErrs = append(allErrs, validateAppSetting(setting, specPath.Child("appSettings").Key(name))...)
+	}
+
+	return allErrs
+}
+
+// validatePorts checks that the additional ports don't reuse the name or
+// number of another port. The main port is named after its protocol
+func validatePorts(function *funcv1.AzureFunction, specPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	names := map[string]bool{}
+	numbers := map[int32]bool{}
+
+	protocol := function.Spec.Protocol
+	if protocol == "" {
+		protocol = funcv1.ProtocolHTTP
+	}
+
+	// the main port is always exposed on port 80 of the service
+	names[protocol] = true
+	numbers[DefaultPort] = true
+	if function.Spec.Port != nil {
+		numbers[*function.Spec.Port] = true
+	}
+
+	for i, port := range function.Spec.Ports {
+		portPath := specPath.Child("ports").Index(i)
+
+		if names[port.Name] {
+			allErrs = append(allErrs, field.Duplicate(portPath.Child("name"), port.Name))
+		}
+
+		if numbers[port.Port] {
+			allErrs = append(allErrs, field.Duplicate(portPath.Child("port"), port.Port))
+		}
+
+		names[port.Name] = true
+		numbers[port.Port] = true
+	}
+
+	return allErrs
+}
+
+// validatePodTemplate checks that the overlay is a pod template and doesn't
+// set the fields of the function container that the controller owns
+func validatePodTemplate(function *funcv1.AzureFunction, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	if function.Spec.PodTemplate == nil || len(function.Spec.PodTemplate.Raw) == 0 {
+		return allErrs
+	}
+
+	template := corev1.PodTemplateSpec{}
+	err := json.Unmarshal(function.Spec.PodTemplate.Raw, &template)
+	if err != nil {
+		return append(allErrs, field.Invalid(path, string(function.Spec.PodTemplate.Raw), err.Error()))
+	}
+
+	for i, container := range template.Spec.Containers {
+		if container.Name != function.Name {
+			continue
+		}
+
+		containerPath := path.Child("spec", "containers").Index(i)
+
+		if container.Image != "" {
+			allErrs = append(allErrs, field.Forbidden(containerPath.Child("image"), "the image of the function container is set by spec.image"))
+		}
+
+		if len(container.Ports) > 0 {
+			allErrs = append(allErrs, field.Forbidden(containerPath.Child("ports"), "the ports of the function container are set by spec.port and spec.ports"))
+		}
+	}
+
+	return allErrs
+}
+
+// httpMethods are the methods a route can be restricted to
+var httpMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// routePathPattern matches the paths that can be rendered into the nginx
+// configuration as is. Quotes, braces, $ and whitespace are left out
+var routePathPattern = regexp.MustCompile(`^/[A-Za-z0-9/._~%!&'()*+,;=:@-]*$`)
+
+// IsHTTPMethod reports whether a route can be restricted to method
+func IsHTTPMethod(method string) bool {
+	return containsString(httpMethods, method)
+}
+
+// IsRoutePath reports whether path can be rendered into the nginx
+// configuration as is
+func IsRoutePath(path string) bool {
+	return routePathPattern.MatchString(path)
+}
+
+// routeFieldPath returns the field of the route at index i of IngressRoutes,
+// where the first offset routes come from ingressRoute
+func routeFieldPath(specPath *field.Path, i int, offset int) *field.Path {
+	if i < offset {
+		return specPath.Child("ingressRoute")
+	}
+
+	return specPath.Child("routes").Index(i - offset)
+}
+
+// validateRoutes checks that no two routes of the function overlap and that
+// their paths and methods are supported
+func validateRoutes(function *funcv1.AzureFunction, specPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	// ingressRoute, when set, comes first
+	routes := function.Spec.IngressRoutes()
+	offset := len(routes) - len(function.Spec.Routes)
+
+	for i := offset; i < len(routes); i++ {
+		route := routes[i]
+		routePath := routeFieldPath(specPath, i, offset)
+
+		for j := 0; j < i; j++ {
+			if route.Overlaps(routes[j]) {
+				allErrs = append(allErrs, field.Invalid(routePath, route.Host+route.Path, "overlaps "+routeFieldPath(specPath, j, offset).String()))
+				break
+			}
+		}
+
+		if !IsRoutePath(route.Path) {
+			allErrs = append(allErrs, field.Invalid(routePath.Child("path"), route.Path, "must start with / and must not contain quotes, braces, $ or whitespace"))
+		}
+
+		for j, method := range route.Methods {
+			if !IsHTTPMethod(string(method)) {
+				allErrs = append(allErrs, field.NotSupported(routePath.Child("methods").Index(j), method, httpMethods))
+			}
+		}
+	}
+
+	return allErrs
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateAppSetting checks that a setting has exactly one source
+func validateAppSetting(setting funcv1.AppSetting, path *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	sources := 0
+	if setting.Value != "" {
+		sources++
+	}
+
+	if setting.ConfigMapKeyRef != nil {
+		sources++
+	}
+
+	if setting.SecretKeyRef != nil {
+		sources++
+	}
+
+	if sources != 1 {
+		allErrs = append(allErrs, field.Invalid(path, "", "must set exactly one of value, configMapKeyRef or secretKeyRef"))
+	}
+
+	return allErrs
+}
+
+// ValidateRoutesUnique checks that no route of the given function overlaps a
+// route of another function, see Route.Overlaps. Private functions aren't
+// routed, so they claim nothing. On update, old is the stored function: the
+// routes it already has are kept whatever other functions claim, so a
+// function is never locked out of its own routes
+func ValidateRoutesUnique(function *funcv1.AzureFunction, old *funcv1.AzureFunction, existing []*funcv1.AzureFunction) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	held := map[string]bool{}
+	if old != nil && old.Spec.AccessPolicy != funcv1.AccessPolicyPrivate {
+		for _, route := range old.Spec.IngressRoutes() {
+			held[route.Key()] = true
+		}
+	}
+
+	routes := function.Spec.IngressRoutes()
+	offset := len(routes) - len(function.Spec.Routes)
+
+	for i, route := range routes {
+		if held[route.Key()] {
+			continue
+		}
+
+		if other := overlappingFunction(function, route, existing); other != nil {
+			allErrs = append(allErrs, field.Invalid(routeFieldPath(field.NewPath("spec"), i, offset), route.Host+route.Path, "overlaps a route of "+other.Namespace+"/"+other.Name))
+		}
+	}
+
+	return allErrs
+}
+
+// overlappingFunction returns a public function other than the given one
+// with a route that overlaps route
+func overlappingFunction(function *funcv1.AzureFunction, route funcv1.Route, existing []*funcv1.AzureFunction) *funcv1.AzureFunction {
+	for _, other := range existing {
+		if other.Namespace == function.Namespace && other.Name == function.Name {
+			continue
+		}
+
+		if other.Spec.AccessPolicy == funcv1.AccessPolicyPrivate {
+			continue
+		}
+
+		for _, otherRoute := range other.Spec.IngressRoutes() {
+			if route.Overlaps(otherRoute) {
+				return other
+			}
+		}
+	}
+
+	return nil
+}
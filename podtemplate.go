@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	funcv1 "github.com/yaron2/azfuncs/pkg/apis/azurefunctions/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+// mergePodTemplate merges the podTemplate overlay of the function onto the
+// generated pod template with strategic-merge semantics, so containers,
+// volumes and the like are merged by name. The function container, its image
+// and ports, and the labels and annotations set by the controller are then
+// restored, whatever the overlay did to them
+func mergePodTemplate(function *funcv1.AzureFunction, template apiv1.PodTemplateSpec) (apiv1.PodTemplateSpec, error) {
+	overlay := function.Spec.PodTemplate
+	if overlay == nil || len(overlay.Raw) == 0 || string(overlay.Raw) == "null" {
+		return template, nil
+	}
+
+	original, err := json.Marshal(template)
+	if err != nil {
+		return template, err
+	}
+
+	patched, err := strategicpatch.StrategicMergePatch(original, overlay.Raw, apiv1.PodTemplateSpec{})
+	if err != nil {
+		return template, fmt.Errorf("merging podTemplate: %v", err)
+	}
+
+	merged := apiv1.PodTemplateSpec{}
+	err = json.Unmarshal(patched, &merged)
+	if err != nil {
+		return template, fmt.Errorf("merging podTemplate: %v", err)
+	}
+
+	owned := template.Spec.Containers[0]
+	found := false
+
+	for i := range merged.Spec.Containers {
+		container := &merged.Spec.Containers[i]
+		if container.Name != owned.Name {
+			continue
+		}
+
+		container.Image = owned.Image
+		container.Ports = owned.Ports
+		found = true
+	}
+
+	if !found {
+		merged.Spec.Containers = append([]apiv1.Container{owned}, merged.Spec.Containers...)
+	}
+
+	if merged.Labels == nil {
+		merged.Labels = map[string]string{}
+	}
+
+	for key, value := range template.Labels {
+		merged.Labels[key] = value
+	}
+
+	if len(template.Annotations) > 0 && merged.Annotations == nil {
+		merged.Annotations = map[string]string{}
+	}
+
+	for key, value := range template.Annotations {
+		merged.Annotations[key] = value
+	}
+
+	return merged, nil
+}
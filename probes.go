@@ -0,0 +1,108 @@
+package main
+
+import (
+	funcv1 "github.com/yaron2/azfuncs/pkg/apis/azurefunctions/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// functionsHostPingPath is the health endpoint of the Functions host. Unlike
+// /admin/host/status it doesn't require the master key
+const functionsHostPingPath = "/admin/host/ping"
+
+// hostProbe returns a probe against the Functions host on the main port of
+// the function container. The kubelet only probes over HTTP/1.1, so HTTP/2
+// and gRPC functions are probed by opening a connection to the port
+func hostProbe(function *funcv1.AzureFunction, periodSeconds int32, failureThreshold int32) *apiv1.Probe {
+	port := intstr.FromString(mainPortName(function))
+
+	handler := apiv1.Handler{
+		TCPSocket: &apiv1.TCPSocketAction{
+			Port: port,
+		},
+	}
+
+	if mainPortName(function) == funcv1.ProtocolHTTP {
+		handler = apiv1.Handler{
+			HTTPGet: &apiv1.HTTPGetAction{
+				Path: functionsHostPingPath,
+				Port: port,
+			},
+		}
+	}
+
+	return &apiv1.Probe{
+		Handler:          handler,
+		TimeoutSeconds:   5,
+		PeriodSeconds:    periodSeconds,
+		FailureThreshold: failureThreshold,
+	}
+}
+
+// desiredProbes returns the liveness, readiness and startup probes of the
+// function container. The startup probe allows five minutes for a cold start
+// before the liveness probe takes over, and any probe set in the spec of the
+// function replaces the default
+func desiredProbes(function *funcv1.AzureFunction) (liveness *apiv1.Probe, readiness *apiv1.Probe, startup *apiv1.Probe) {
+	liveness = hostProbe(function, 20, 3)
+	readiness = hostProbe(function, 10, 3)
+	startup = hostProbe(function, 5, 60)
+
+	probes := function.Spec.Probes
+	if probes == nil {
+		return liveness, readiness, startup
+	}
+
+	if probes.Liveness != nil {
+		liveness = probes.Liveness
+	}
+
+	if probes.Readiness != nil {
+		readiness = probes.Readiness
+	}
+
+	if probes.Startup != nil {
+		startup = probes.Startup
+	}
+
+	return liveness, readiness, startup
+}
+
+// podsNotReadyReason explains why a function has no ready replica, from the
+// state of the containers of its pods
+func (t *AzureFunctionsHandler) podsNotReadyReason(function *funcv1.AzureFunction) (string, string) {
+	selector := labels.SelectorFromSet(labels.Set{
+		functionNameLabel:      function.Name,
+		functionNamespaceLabel: function.Namespace,
+	})
+
+	pods, err := t.PodsLister.Pods(t.workloadNamespace(function)).List(selector)
+	if err != nil || len(pods) == 0 {
+		return "NoReadyReplicas", "Waiting for the pods of the function to be created"
+	}
+
+	for _, pod := range pods {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name != function.Name || status.Ready {
+				continue
+			}
+
+			if status.State.Waiting != nil && status.State.Waiting.Reason != "" && status.State.Waiting.Reason != "ContainerCreating" {
+				return status.State.Waiting.Reason, status.State.Waiting.Message
+			}
+
+			if status.State.Running == nil {
+				continue
+			}
+
+			if status.Started != nil && !*status.Started {
+				return "StartupProbePending", "Waiting for the Functions host of pod " + pod.Name + " to start"
+			}
+
+			return "ReadinessProbeFailing", "Readiness probe of pod " + pod.Name + " is failing"
+		}
+	}
+
+	return "NoReadyReplicas", "Waiting for a replica of the function to become ready"
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+
+	funcv1 "github.com/yaron2/azfuncs/pkg/apis/azurefunctions/v1"
+	apiv1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// imagePullFailureReasons are the waiting reasons of a container whose image
+// can't be pulled
+var imagePullFailureReasons = map[string]bool{
+	"ErrImagePull":      true,
+	"ImagePullBackOff":  true,
+	"InvalidImageName":  true,
+	"ErrImageNeverPull": true,
+}
+
+// imagePullSecrets returns the pull secrets of the function pod: the ones in
+// the spec of the function followed by the default secret of the controller
+func (t *AzureFunctionsHandler) imagePullSecrets(function *funcv1.AzureFunction) []apiv1.LocalObjectReference {
+	secrets := append([]apiv1.LocalObjectReference{}, function.Spec.ImagePullSecrets...)
+
+	defaultSecret := t.Config.Get().Workload.ImagePullSecret
+	if defaultSecret != "" {
+		listed := false
+		for _, secret := range secrets {
+			listed = listed || secret.Name == defaultSecret
+		}
+
+		if !listed {
+			secrets = append(secrets, apiv1.LocalObjectReference{Name: defaultSecret})
+		}
+	}
+
+	if len(secrets) == 0 {
+		return nil
+	}
+
+	return secrets
+}
+
+// applyImagePullSecret copies the default pull secret of the controller into
+// the namespace the function runs in, and keeps the copy up to date. A secret
+// of the same name that wasn't created by the controller is left alone
+func (t *AzureFunctionsHandler) applyImagePullSecret(function *funcv1.AzureFunction) error {
+	cfg := t.Config.Get()
+	name := cfg.Workload.ImagePullSecret
+	namespace := t.workloadNamespace(function)
+
+	if name == "" || namespace == cfg.Namespace {
+		return nil
+	}
+
+	source, err := t.ControllerSecretsLister.Secrets(cfg.Namespace).Get(name)
+	if err != nil {
+		return fmt.Errorf("reading image pull secret %s/%s: %v", cfg.Namespace, name, err)
+	}
+
+	existing, err := t.SecretsLister.Secrets(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		_, err = clientSet.CoreV1().Secrets(namespace).Create(&apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+				Labels: map[string]string{
+					managedByLabel: managedByValue,
+				},
+			},
+			Type: source.Type,
+			Data: source.Data,
+		})
+		if errors.IsAlreadyExists(err) {
+			return nil
+		}
+
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if existing.Labels[managedByLabel] != managedByValue {
+		return nil
+	}
+
+	if existing.Type == source.Type && apiequality.Semantic.DeepEqual(existing.Data, source.Data) {
+		return nil
+	}
+
+	updated := existing.DeepCopy()
+	updated.Type = source.Type
+	updated.Data = source.Data
+
+	_, err = clientSet.CoreV1().Secrets(namespace).Update(updated)
+	return err
+}
+
+// setImagePulledCondition reports whether the pods of the function could pull
+// its image. It is False as soon as one of them fails to, and Unknown until a
+// container has been started from the image
+func (t *AzureFunctionsHandler) setImagePulledCondition(function *funcv1.AzureFunction) {
+	selector := labels.SelectorFromSet(labels.Set{
+		functionNameLabel:      function.Name,
+		functionNamespaceLabel: function.Namespace,
+	})
+
+	pods, err := t.PodsLister.Pods(t.workloadNamespace(function)).List(selector)
+	if err != nil {
+		return
+	}
+
+	pulled := false
+	for _, pod := range pods {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name != function.Name {
+				continue
+			}
+
+			if status.State.Waiting != nil && imagePullFailureReasons[status.State.Waiting.Reason] {
+				function.Status.SetCondition(funcv1.FunctionImagePulled, apiv1.ConditionFalse, status.State.Waiting.Reason, status.State.Waiting.Message)
+				return
+			}
+
+			pulled = pulled || status.ImageID != ""
+		}
+	}
+
+	if pulled {
+		function.Status.SetCondition(funcv1.FunctionImagePulled, apiv1.ConditionTrue, "ImagePulled", "Pulled image "+function.Spec.Image)
+	} else {
+		function.Status.SetCondition(funcv1.FunctionImagePulled, apiv1.ConditionUnknown, "ImagePullPending", "Waiting for the image to be pulled")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/yaron2/azfuncs/config"
+	funcv1 "github.com/yaron2/azfuncs/pkg/apis/azurefunctions/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TestImagePullSecretIsCopiedFromCache checks that the default pull secret is
+// read from the cache of the namespace of the controller, in both layouts
+func TestImagePullSecretIsCopiedFromCache(t *testing.T) {
+	for _, sharedNamespace := range []string{"", "functions"} {
+		cfg := config.Default()
+		cfg.Workload.ImagePullSecret = "registry"
+
+		source := &apiv1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "registry", Namespace: cfg.Namespace},
+			Type:       apiv1.SecretTypeDockerConfigJson,
+			Data:       map[string][]byte{apiv1.DockerConfigJsonKey: []byte("{}")},
+		}
+
+		e := newTestEnv(t, source)
+		e.handler.Config.Set(cfg)
+		e.handler.SharedNamespace = sharedNamespace
+
+		function := &funcv1.AzureFunction{
+			ObjectMeta: metav1.ObjectMeta{Name: testName, Namespace: testNamespace},
+		}
+
+		e.sync()
+		e.kube.ClearActions()
+
+		err := e.handler.applyImagePullSecret(function)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, action := range e.kube.Actions() {
+			if action.GetVerb() != "create" {
+				t.Errorf("expected the secrets to be read from the cache, got %v", action)
+			}
+		}
+
+		namespace := e.handler.workloadNamespace(function)
+
+		copied, err := e.kube.CoreV1().Secrets(namespace).Get("registry", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("expected the secret to be copied to %s: %v", namespace, err)
+		}
+
+		if copied.Type != source.Type || string(copied.Data[apiv1.DockerConfigJsonKey]) != "{}" {
+			t.Errorf("expected the copy to match the source, got %v", copied)
+		}
+	}
+}
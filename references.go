@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	funcv1 "github.com/yaron2/azfuncs/pkg/apis/azurefunctions/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// configHashAnnotation is set on the pod template to a hash of the ConfigMaps
+// and Secrets the function reads its settings from, so changing one of them
+// rolls the pods of the function
+const configHashAnnotation = "azurefunctions.dev.azure.com/config-hash"
+
+// ConfigReferencesIndex indexes functions by the ConfigMaps and Secrets they
+// reference, as "<kind>/<namespace>/<name>"
+const ConfigReferencesIndex = "configReferences"
+
+const (
+	configMapKind = "ConfigMap"
+	secretKind    = "Secret"
+)
+
+// configReference is a ConfigMap or Secret a function reads settings from
+type configReference struct {
+	kind      string
+	namespace string
+	name      string
+}
+
+func configReferenceKey(kind string, namespace string, name string) string {
+	return kind + "/" + namespace + "/" + name
+}
+
+func (r configReference) key() string {
+	return configReferenceKey(r.kind, r.namespace, r.name)
+}
+
+// configReferences returns the ConfigMaps and Secrets the function reads
+// settings from, sorted and without duplicates. They are looked up in the
+// namespace the function runs in
+func (t *AzureFunctionsHandler) configReferences(function *funcv1.AzureFunction) []configReference {
+	namespace := t.workloadNamespace(function)
+	references := map[string]configReference{}
+
+	add := func(kind string, name string) {
+		reference := configReference{kind: kind, namespace: namespace, name: name}
+		references[reference.key()] = reference
+	}
+
+	addKeySelectors := func(configMap *apiv1.ConfigMapKeySelector, secret *apiv1.SecretKeySelector) {
+		if configMap != nil {
+			add(configMapKind, configMap.Name)
+		}
+
+		if secret != nil {
+			add(secretKind, secret.Name)
+		}
+	}
+
+	for _, setting := range function.Spec.AppSettings {
+		addKeySelectors(setting.ConfigMapKeyRef, setting.SecretKeyRef)
+	}
+
+	for _, env := range function.Spec.Env {
+		if env.ValueFrom != nil {
+			addKeySelectors(env.ValueFrom.ConfigMapKeyRef, env.ValueFrom.SecretKeyRef)
+		}
+	}
+
+	for _, envFrom := range function.Spec.EnvFrom {
+		if envFrom.ConfigMapRef != nil {
+			add(configMapKind, envFrom.ConfigMapRef.Name)
+		}
+
+		if envFrom.SecretRef != nil {
+			add(secretKind, envFrom.SecretRef.Name)
+		}
+	}
+
+	keys := []string{}
+	for key := range references {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	sorted := []configReference{}
+	for _, key := range keys {
+		sorted = append(sorted, references[key])
+	}
+
+	return sorted
+}
+
+// ConfigReferencesIndexFunc is the index function of ConfigReferencesIndex
+func (t *AzureFunctionsHandler) ConfigReferencesIndexFunc(obj interface{}) ([]string, error) {
+	function, ok := obj.(*funcv1.AzureFunction)
+	if !ok {
+		return nil, fmt.Errorf("expected an AzureFunction, got %T", obj)
+	}
+
+	keys := []string{}
+	for _, reference := range t.configReferences(function) {
+		keys = append(keys, reference.key())
+	}
+
+	return keys, nil
+}
+
+// configHash hashes the content of every ConfigMap and Secret the function
+// references. A missing one is hashed as missing, so the pods are rolled
+// once it is created
+func (t *AzureFunctionsHandler) configHash(function *funcv1.AzureFunction) (string, error) {
+	references := t.configReferences(function)
+	if len(references) == 0 {
+		return "", nil
+	}
+
+	hash := sha256.New()
+	for _, reference := range references {
+		fmt.Fprintf(hash, "%s\n", reference.key())
+
+		data := map[string][]byte{}
+		switch reference.kind {
+		case configMapKind:
+			configMap, err := t.ConfigMapsLister.ConfigMaps(reference.namespace).Get(reference.name)
+			if errors.IsNotFound(err) {
+				fmt.Fprint(hash, "missing\n")
+				continue
+			}
+			if err != nil {
+				return "", err
+			}
+
+			for key, value := range configMap.Data {
+				data[key] = []byte(value)
+			}
+
+			for key, value := range configMap.BinaryData {
+				data[key] = value
+			}
+		case secretKind:
+			secret, err := t.SecretsLister.Secrets(reference.namespace).Get(reference.name)
+			if errors.IsNotFound(err) {
+				fmt.Fprint(hash, "missing\n")
+				continue
+			}
+			if err != nil {
+				return "", err
+			}
+
+			data = secret.Data
+		}
+
+		keys := []string{}
+		for key := range data {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(hash, "%s=%x\n", key, data[key])
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ConfigReferenceEventHandler enqueues the functions that reference a
+// ConfigMap or Secret whenever it is added, changed or deleted, so their
+// config hash and with it their pods are updated
+func (t *AzureFunctionsHandler) ConfigReferenceEventHandler(queue workqueue.Interface, functions cache.Indexer) cache.ResourceEventHandler {
+	enqueue := func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+
+		var kind string
+		switch obj.(type) {
+		case *apiv1.ConfigMap:
+			kind = configMapKind
+		case *apiv1.Secret:
+			kind = secretKind
+		default:
+			return
+		}
+
+		object := obj.(metav1.Object)
+		referencing, err := functions.ByIndex(ConfigReferencesIndex, configReferenceKey(kind, object.GetNamespace(), object.GetName()))
+		if err != nil {
+			return
+		}
+
+		for _, function := range referencing {
+			key, err := cache.MetaNamespaceKeyFunc(function)
+			if err == nil {
+				queue.Add(key)
+			}
+		}
+	}
+
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if oldObj.(metav1.Object).GetResourceVersion() == newObj.(metav1.Object).GetResourceVersion() {
+				return
+			}
+
+			enqueue(newObj)
+		},
+		DeleteFunc: enqueue,
+	}
+}
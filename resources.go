@@ -0,0 +1,612 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	funcv1 "github.com/yaron2/azfuncs/pkg/apis/azurefunctions/v1"
+	"github.com/yaron2/azfuncs/pkg/validation"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/api/extensions/v1beta1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// servicePort is the port the main port of a function is exposed on by its
+// service, whichever port the container listens on
+const servicePort = 80
+
+// Every resource created for a function is labelled with the function it
+// belongs to, so changes to it can be traced back to the function even
+// when it has no owner reference
+const (
+	functionNameLabel      = "azurefunctions.dev.azure.com/name"
+	functionNamespaceLabel = "azurefunctions.dev.azure.com/namespace"
+)
+
+// specHashAnnotation and ownedAnnotationsAnnotation record what the controller
+// last applied to an object. Existing objects are compared with DeepDerivative,
+// which can't tell a field removed from the spec of a function from a field
+// defaulted by the API server, so a changed hash forces the update. The owned
+// annotations are removed once the controller stops setting them
+const (
+	specHashAnnotation         = "azurefunctions.dev.azure.com/spec-hash"
+	ownedAnnotationsAnnotation = "azurefunctions.dev.azure.com/owned-annotations"
+)
+
+// managedByLabel marks the resources created by the controller. The informers
+// for owned resources only watch objects that carry it
+const (
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedByValue = "azure-functions-controller"
+)
+
+// mainPortName names the main port of the function container after its
+// protocol. Probes, services and ingresses refer to it by this name, and
+// meshes such as Istio detect the protocol from it
+func mainPortName(function *funcv1.AzureFunction) string {
+	if function.Spec.Protocol == "" {
+		return funcv1.ProtocolHTTP
+	}
+
+	return function.Spec.Protocol
+}
+
+func mainPort(function *funcv1.AzureFunction) int32 {
+	if function.Spec.Port == nil {
+		return servicePort
+	}
+
+	return *function.Spec.Port
+}
+
+func deploymentName(name string) string { return name + "-deployment" }
+func serviceName(name string) string    { return name + "-service" }
+func ingressName(name string) string    { return name + "-ingress" }
+func autoscalerName(name string) string { return name }
+
+// desiredDeployment builds the Deployment for a function, with the podTemplate
+// overlay of the function merged onto its pods. Replicas are left unset so
+// the autoscaler stays in charge of them
+func (t *AzureFunctionsHandler) desiredDeployment(function *funcv1.AzureFunction, configHash string) (*appsv1.Deployment, error) {
+	workload := t.Config.Get().Workload
+
+	liveness, readiness, startup := desiredProbes(function)
+
+	podAnnotations := t.componentPodAnnotations()
+	if configHash != "" {
+		podAnnotations[configHashAnnotation] = configHash
+	}
+
+	if len(podAnnotations) == 0 {
+		podAnnotations = nil
+	}
+
+	podSpec := apiv1.PodSpec{
+		Containers: []apiv1.Container{
+			{
+				Name:           function.ObjectMeta.Name,
+				Image:          function.Spec.Image,
+				Env:            functionEnv(function),
+				EnvFrom:        function.Spec.EnvFrom,
+				Resources:      function.Spec.Resources,
+				LivenessProbe:  liveness,
+				ReadinessProbe: readiness,
+				StartupProbe:   startup,
+				Ports:          containerPorts(function),
+			},
+		},
+		ImagePullSecrets: t.imagePullSecrets(function),
+	}
+
+	applyScheduling(function, workload, &podSpec)
+
+	template, err := mergePodTemplate(function, apiv1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:      functionLabels(function),
+			Annotations: podAnnotations,
+		},
+		Spec: podSpec,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// replicas that don't fit on real nodes are run by the burst Deployment
+	if function.Spec.BurstPolicy == funcv1.BurstPolicyVirtualNodes {
+		excludeVirtualNodes(&template.Spec, workload.VirtualNodes)
+	}
+
+	return &appsv1.Deployment{
+		ObjectMeta: t.childObjectMeta(function, deploymentName(function.Name)),
+		Spec: appsv1.DeploymentSpec{
+			Selector: mainSelector(function),
+			Template: template,
+		},
+	}, nil
+}
+
+// containerPorts lists the main port of the function container followed by
+// its additional ports
+func containerPorts(function *funcv1.AzureFunction) []apiv1.ContainerPort {
+	ports := []apiv1.ContainerPort{
+		{
+			Name:          mainPortName(function),
+			Protocol:      apiv1.ProtocolTCP,
+			ContainerPort: mainPort(function),
+		},
+	}
+
+	for _, port := range function.Spec.Ports {
+		ports = append(ports, apiv1.ContainerPort{
+			Name:          port.Name,
+			Protocol:      apiv1.ProtocolTCP,
+			ContainerPort: port.Port,
+		})
+	}
+
+	return ports
+}
+
+// functionLabels are set on every resource created for a function, including
+// its pods so the controller can watch them. The selector of the Deployment
+// only uses the app label, since it can't be changed once created
+func functionLabels(function *funcv1.AzureFunction) map[string]string {
+	return map[string]string{
+		"app":                  function.ObjectMeta.Name,
+		functionNameLabel:      function.Name,
+		functionNamespaceLabel: function.Namespace,
+		managedByLabel:         managedByValue,
+	}
+}
+
+// functionEnv renders the app settings of a function, sorted by name, followed
+// by its env, so a variable set in both takes its value from env
+func functionEnv(function *funcv1.AzureFunction) []apiv1.EnvVar {
+	names := []string{}
+	for name := range function.Spec.AppSettings {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	env := []apiv1.EnvVar{}
+	for _, name := range names {
+		setting := function.Spec.AppSettings[name]
+		envVar := apiv1.EnvVar{
+			Name:  name,
+			Value: setting.Value,
+		}
+
+		if setting.ConfigMapKeyRef != nil || setting.SecretKeyRef != nil {
+			envVar.ValueFrom = &apiv1.EnvVarSource{
+				ConfigMapKeyRef: setting.ConfigMapKeyRef,
+				SecretKeyRef:    setting.SecretKeyRef,
+			}
+		}
+
+		env = append(env, envVar)
+	}
+
+	env = append(env, function.Spec.Env...)
+
+	if len(env) == 0 {
+		return nil
+	}
+
+	return env
+}
+
+// desiredAutoscaler builds the autoscaler for a function. It always scales
+// on CPU, and on memory too when the function sets a memory target
+func (t *AzureFunctionsHandler) desiredAutoscaler(function *funcv1.AzureFunction) *autoscalingv2beta2.HorizontalPodAutoscaler {
+	targetCPU := t.Config.Get().Workload.TargetCPUUtilizationPercentage
+	var targetMemory *int32
+
+	if scale := function.Spec.Scale; scale != nil {
+		if scale.TargetCPUUtilizationPercentage != nil {
+			targetCPU = *scale.TargetCPUUtilizationPercentage
+		}
+
+		targetMemory = scale.TargetMemoryUtilizationPercentage
+	}
+
+	metrics := []autoscalingv2beta2.MetricSpec{
+		resourceUtilizationMetric(apiv1.ResourceCPU, targetCPU),
+	}
+
+	if targetMemory != nil {
+		metrics = append(metrics, resourceUtilizationMetric(apiv1.ResourceMemory, *targetMemory))
+	}
+
+	return &autoscalingv2beta2.HorizontalPodAutoscaler{
+		ObjectMeta: t.childObjectMeta(function, autoscalerName(function.Name)),
+		Spec: autoscalingv2beta2.HorizontalPodAutoscalerSpec{
+			MinReplicas: int32Ptr(minReplicas(function)),
+			MaxReplicas: *function.Spec.MaxReplicas(),
+			Metrics:     metrics,
+			ScaleTargetRef: autoscalingv2beta2.CrossVersionObjectReference{
+				APIVersion: "apps/v1",
+				Kind:       "Deployment",
+				Name:       deploymentName(function.Name),
+			},
+		},
+	}
+}
+
+func resourceUtilizationMetric(resource apiv1.ResourceName, target int32) autoscalingv2beta2.MetricSpec {
+	return autoscalingv2beta2.MetricSpec{
+		Type: autoscalingv2beta2.ResourceMetricSourceType,
+		Resource: &autoscalingv2beta2.ResourceMetricSource{
+			Name: resource,
+			Target: autoscalingv2beta2.MetricTarget{
+				Type:               autoscalingv2beta2.UtilizationMetricType,
+				AverageUtilization: int32Ptr(target),
+			},
+		},
+	}
+}
+
+// desiredService builds the service of a function. It selects the pods of the
+// burst Deployment as well as the pods of the main one
+func (t *AzureFunctionsHandler) desiredService(function *funcv1.AzureFunction, ingressEnabled bool) *apiv1.Service {
+	serviceType := apiv1.ServiceTypeLoadBalancer
+	if function.Spec.AccessPolicy == funcv1.AccessPolicyPrivate || ingressEnabled {
+		serviceType = apiv1.ServiceTypeClusterIP
+	}
+
+	return &apiv1.Service{
+		ObjectMeta: t.childObjectMeta(function, serviceName(function.Name)),
+		Spec: apiv1.ServiceSpec{
+			Selector: map[string]string{
+				"app": function.ObjectMeta.Name,
+			},
+			Ports: servicePorts(function),
+			Type:  serviceType,
+		},
+	}
+}
+
+// servicePorts exposes the main port of the function on port 80 and its
+// additional ports on their own numbers, all targeting the container ports
+// by name
+func servicePorts(function *funcv1.AzureFunction) []apiv1.ServicePort {
+	ports := []apiv1.ServicePort{
+		{
+			Name:       mainPortName(function),
+			Protocol:   apiv1.ProtocolTCP,
+			Port:       servicePort,
+			TargetPort: intstr.FromString(mainPortName(function)),
+		},
+	}
+
+	for _, port := range function.Spec.Ports {
+		ports = append(ports, apiv1.ServicePort{
+			Name:       port.Name,
+			Protocol:   apiv1.ProtocolTCP,
+			Port:       port.Port,
+			TargetPort: intstr.FromString(port.Name),
+		})
+	}
+
+	return ports
+}
+
+// desiredIngress routes a route of the function to the main port of its
+// service. Each route gets its own Ingress, since nginx applies annotations
+// to all paths of an Ingress:
+//   - gRPC backends are proxied as gRPC and their paths are passed through
+//     unchanged, since gRPC routes on the full method path
+//   - exact paths are served by the location of their path, which rejects
+//     the requests below it. A regular expression would turn on regex
+//     matching for every path on the host, including other functions
+//   - methods are filtered with limit_except
+//
+// The path and methods are written into the nginx configuration, so they are
+// checked here as well as on admission, which may not be set up
+func (t *AzureFunctionsHandler) desiredIngress(function *funcv1.AzureFunction, route functionRoute) (*v1beta1.Ingress, error) {
+	if !validation.IsRoutePath(route.Path) {
+		return nil, fmt.Errorf("path %q of route %s%s is not supported", route.Path, route.Host, route.Path)
+	}
+
+	for _, method := range route.Methods {
+		if !validation.IsHTTPMethod(string(method)) {
+			return nil, fmt.Errorf("method %q of route %s%s is not supported", method, route.Host, route.Path)
+		}
+	}
+
+	meta := t.childObjectMeta(function, route.ingressName)
+	meta.Annotations = map[string]string{
+		"nginx.ingress.kubernetes.io/ssl-redirect": strconv.FormatBool(false),
+	}
+
+	if function.Spec.Protocol == funcv1.ProtocolGRPC {
+		meta.Annotations["nginx.ingress.kubernetes.io/backend-protocol"] = "GRPC"
+	} else if route.rewrite {
+		meta.Annotations["nginx.ingress.kubernetes.io/rewrite-target"] = "/"
+	}
+
+	// snippets only apply to the location of the Ingress, paths are
+	// validated not to need quoting
+	snippet := ""
+	if route.PathType == funcv1.PathTypeExact {
+		snippet += "if ($uri != \"" + route.Path + "\") { return 404; }\n"
+	}
+
+	if len(route.Methods) > 0 {
+		methods := []string{}
+		for _, method := range route.Methods {
+			methods = append(methods, string(method))
+		}
+
+		snippet += "limit_except " + strings.Join(methods, " ") + " { deny all; }\n"
+	}
+
+	if snippet != "" {
+		meta.Annotations["nginx.ingress.kubernetes.io/configuration-snippet"] = snippet
+	}
+
+	ingress := &v1beta1.Ingress{
+		ObjectMeta: meta,
+		Spec: v1beta1.IngressSpec{
+			Rules: []v1beta1.IngressRule{
+				{
+					Host: route.Host,
+					IngressRuleValue: v1beta1.IngressRuleValue{
+						HTTP: &v1beta1.HTTPIngressRuleValue{
+							Paths: []v1beta1.HTTPIngressPath{
+								{
+									Path: route.Path,
+									Backend: v1beta1.IngressBackend{
+										ServiceName: serviceName(function.Name),
+										ServicePort: intstr.FromString(mainPortName(function)),
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	return ingress, nil
+}
+
+// setAppliedState records the hash of spec and the annotations set in meta on
+// meta itself. It is called on desired objects right before they are applied
+func setAppliedState(meta *metav1.ObjectMeta, spec interface{}) {
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+
+	keys := []string{}
+	for key := range meta.Annotations {
+		if key != specHashAnnotation && key != ownedAnnotationsAnnotation {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	// specs are API types, which always marshal
+	data, _ := json.Marshal(spec)
+	hash := sha256.Sum256(data)
+
+	meta.Annotations[ownedAnnotationsAnnotation] = strings.Join(keys, ",")
+	meta.Annotations[specHashAnnotation] = hex.EncodeToString(hash[:])
+}
+
+// metaDiffers reports whether the labels, annotations or owner references
+// we set are missing from an existing object
+func metaDiffers(desired metav1.ObjectMeta, existing metav1.ObjectMeta) bool {
+	return !apiequality.Semantic.DeepDerivative(desired.Labels, existing.Labels) ||
+		!apiequality.Semantic.DeepDerivative(desired.Annotations, existing.Annotations) ||
+		!apiequality.Semantic.DeepDerivative(desired.OwnerReferences, existing.OwnerReferences)
+}
+
+// mergeMeta copies the metadata we own onto an existing object, leaving
+// labels and annotations added by others in place. Annotations we set before
+// but no longer want are removed
+func mergeMeta(desired metav1.ObjectMeta, existing *metav1.ObjectMeta) {
+	if existing.Labels == nil {
+		existing.Labels = map[string]string{}
+	}
+
+	for k, v := range desired.Labels {
+		existing.Labels[k] = v
+	}
+
+	if existing.Annotations == nil {
+		existing.Annotations = map[string]string{}
+	}
+
+	for _, k := range strings.Split(existing.Annotations[ownedAnnotationsAnnotation], ",") {
+		if _, ok := desired.Annotations[k]; !ok {
+			delete(existing.Annotations, k)
+		}
+	}
+
+	for k, v := range desired.Annotations {
+		existing.Annotations[k] = v
+	}
+
+	if desired.OwnerReferences != nil {
+		existing.OwnerReferences = desired.OwnerReferences
+	}
+}
+
+// The apply functions create the object when it doesn't exist and update it
+// when the fields we own have drifted or the desired spec has changed. The
+// existing object is read from the informer cache and fields defaulted by the
+// API server are ignored when comparing, so an object that already matches
+// costs no API call at all. An update replaces the whole spec, so fields
+// removed from the function are removed from the object too
+//
+// objects created by older versions of the controller don't carry the
+// managed-by label and are missing from the cache. Creating them fails with
+// AlreadyExists, in which case they are read from the API server once and
+// adopted by adding the label
+
+func (t *AzureFunctionsHandler) applyDeployment(desired *appsv1.Deployment) (*appsv1.Deployment, error) {
+	client := clientSet.AppsV1().Deployments(desired.Namespace)
+
+	// replicas are only set to scale the Deployment up to min, depending on
+	// what the autoscaler did, so they are compared below but not hashed
+	hashed := desired.Spec.DeepCopy()
+	hashed.Replicas = nil
+	setAppliedState(&desired.ObjectMeta, hashed)
+
+	existing, err := t.DeploymentsLister.Deployments(desired.Namespace).Get(desired.Name)
+	if errors.IsNotFound(err) {
+		var created *appsv1.Deployment
+		created, err = client.Create(desired)
+		if !errors.IsAlreadyExists(err) {
+			return created, err
+		}
+
+		existing, err = client.Get(desired.Name, metav1.GetOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the selector of a Deployment can't be changed. A Deployment with
+	// another selector is deleted without its ReplicaSets, which the one
+	// created by the next reconcile adopts, so the pods keep serving
+	if !apiequality.Semantic.DeepEqual(desired.Spec.Selector, existing.Spec.Selector) {
+		orphan := metav1.DeletePropagationOrphan
+		err = client.Delete(existing.Name, &metav1.DeleteOptions{PropagationPolicy: &orphan})
+		if err != nil && !errors.IsNotFound(err) {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("deployment %s/%s is being replaced to change its selector", existing.Namespace, existing.Name)
+	}
+
+	if !metaDiffers(desired.ObjectMeta, existing.ObjectMeta) && apiequality.Semantic.DeepDerivative(desired.Spec, existing.Spec) {
+		return existing, nil
+	}
+
+	updated := existing.DeepCopy()
+	mergeMeta(desired.ObjectMeta, &updated.ObjectMeta)
+	updated.Spec = desired.Spec
+
+	// replicas are left to the autoscaler unless they are set explicitly
+	if desired.Spec.Replicas == nil {
+		updated.Spec.Replicas = existing.Spec.Replicas
+	}
+
+	return client.Update(updated)
+}
+
+func (t *AzureFunctionsHandler) applyAutoscaler(desired *autoscalingv2beta2.HorizontalPodAutoscaler) (*autoscalingv2beta2.HorizontalPodAutoscaler, error) {
+	client := clientSet.AutoscalingV2beta2().HorizontalPodAutoscalers(desired.Namespace)
+	setAppliedState(&desired.ObjectMeta, desired.Spec)
+
+	existing, err := t.AutoscalersLister.HorizontalPodAutoscalers(desired.Namespace).Get(desired.Name)
+	if errors.IsNotFound(err) {
+		var created *autoscalingv2beta2.HorizontalPodAutoscaler
+		created, err = client.Create(desired)
+		if !errors.IsAlreadyExists(err) {
+			return created, err
+		}
+
+		existing, err = client.Get(desired.Name, metav1.GetOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !metaDiffers(desired.ObjectMeta, existing.ObjectMeta) && apiequality.Semantic.DeepDerivative(desired.Spec, existing.Spec) {
+		return existing, nil
+	}
+
+	updated := existing.DeepCopy()
+	mergeMeta(desired.ObjectMeta, &updated.ObjectMeta)
+	updated.Spec = desired.Spec
+
+	return client.Update(updated)
+}
+
+func (t *AzureFunctionsHandler) applyService(desired *apiv1.Service) (*apiv1.Service, error) {
+	client := clientSet.CoreV1().Services(desired.Namespace)
+	setAppliedState(&desired.ObjectMeta, desired.Spec)
+
+	existing, err := t.ServicesLister.Services(desired.Namespace).Get(desired.Name)
+	if errors.IsNotFound(err) {
+		var created *apiv1.Service
+		created, err = client.Create(desired)
+		if !errors.IsAlreadyExists(err) {
+			return created, err
+		}
+
+		existing, err = client.Get(desired.Name, metav1.GetOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// node ports are allocated by the API server, so they only count as
+	// drift when the service moves to a type that must not have them
+	typeChanged := desired.Spec.Type != existing.Spec.Type
+	if !typeChanged && !metaDiffers(desired.ObjectMeta, existing.ObjectMeta) && apiequality.Semantic.DeepDerivative(desired.Spec, existing.Spec) {
+		return existing, nil
+	}
+
+	nodePorts := map[string]int32{}
+	for _, port := range existing.Spec.Ports {
+		nodePorts[port.Name] = port.NodePort
+	}
+
+	updated := existing.DeepCopy()
+	mergeMeta(desired.ObjectMeta, &updated.ObjectMeta)
+	updated.Spec = desired.Spec
+	updated.Spec.ClusterIP = existing.Spec.ClusterIP
+
+	if updated.Spec.Type != apiv1.ServiceTypeClusterIP {
+		for i := range updated.Spec.Ports {
+			updated.Spec.Ports[i].NodePort = nodePorts[updated.Spec.Ports[i].Name]
+		}
+	}
+
+	return client.Update(updated)
+}
+
+func (t *AzureFunctionsHandler) applyIngress(desired *v1beta1.Ingress) (*v1beta1.Ingress, error) {
+	client := clientSet.ExtensionsV1beta1().Ingresses(desired.Namespace)
+	setAppliedState(&desired.ObjectMeta, desired.Spec)
+
+	existing, err := t.IngressesLister.Ingresses(desired.Namespace).Get(desired.Name)
+	if errors.IsNotFound(err) {
+		var created *v1beta1.Ingress
+		created, err = client.Create(desired)
+		if !errors.IsAlreadyExists(err) {
+			return created, err
+		}
+
+		existing, err = client.Get(desired.Name, metav1.GetOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !metaDiffers(desired.ObjectMeta, existing.ObjectMeta) && apiequality.Semantic.DeepDerivative(desired.Spec, existing.Spec) {
+		return existing, nil
+	}
+
+	updated := existing.DeepCopy()
+	mergeMeta(desired.ObjectMeta, &updated.ObjectMeta)
+	updated.Spec = desired.Spec
+
+	return client.Update(updated)
+}
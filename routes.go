@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	funcv1 "github.com/yaron2/azfuncs/pkg/apis/azurefunctions/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// RoutesIndex indexes public functions by the hosts of their routes, so the
+// functions whose routes may overlap can be found without listing all of them
+const RoutesIndex = "routes"
+
+func routeIngressName(name string, index int) string { return name + "-route-" + strconv.Itoa(index) }
+
+// functionRoute is a route of a function and the Ingress it is rendered into
+type functionRoute struct {
+	funcv1.Route
+
+	ingressName string
+
+	// rewrite sends every request to the root of the function, which is
+	// how ingressRoute has always been routed
+	rewrite bool
+}
+
+// RoutesIndexFunc is the index function of RoutesIndex. Private functions
+// aren't routed, so they claim no route
+func (t *AzureFunctionsHandler) RoutesIndexFunc(obj interface{}) ([]string, error) {
+	function, ok := obj.(*funcv1.AzureFunction)
+	if !ok {
+		return nil, fmt.Errorf("expected an AzureFunction, got %T", obj)
+	}
+
+	if function.Spec.AccessPolicy == funcv1.AccessPolicyPrivate {
+		return nil, nil
+	}
+
+	hosts := []string{}
+	seen := map[string]bool{}
+
+	for _, route := range function.Spec.IngressRoutes() {
+		if !seen[route.Host] {
+			hosts = append(hosts, route.Host)
+			seen[route.Host] = true
+		}
+	}
+
+	return hosts, nil
+}
+
+// functionRoutes returns the routes of a function that can be rendered, and
+// a message for each route that overlaps a route of another function. When
+// the routes of two functions overlap, the older function keeps its route
+func (t *AzureFunctionsHandler) functionRoutes(function *funcv1.AzureFunction) ([]functionRoute, []string) {
+	routes := []functionRoute{}
+	conflicts := []string{}
+
+	// ingressRoute, when set, comes first
+	all := function.Spec.IngressRoutes()
+	offset := len(all) - len(function.Spec.Routes)
+
+	for i, route := range all {
+		owner := t.routeOwner(function, route)
+		if owner != nil {
+			conflicts = append(conflicts, fmt.Sprintf("%s%s overlaps a route of %s/%s", route.Host, route.Path, owner.Namespace, owner.Name))
+			continue
+		}
+
+		if i < offset {
+			routes = append(routes, functionRoute{Route: route, ingressName: ingressName(function.Name), rewrite: true})
+		} else {
+			routes = append(routes, functionRoute{Route: route, ingressName: routeIngressName(function.Name, i-offset)})
+		}
+	}
+
+	return routes, conflicts
+}
+
+// routeOwner returns the oldest function other than the given one with a
+// route that overlaps route, when it is older than the given function
+func (t *AzureFunctionsHandler) routeOwner(function *funcv1.AzureFunction, route funcv1.Route) *funcv1.AzureFunction {
+	sameHost, err := t.FunctionsIndexer.ByIndex(RoutesIndex, route.Host)
+	if err != nil {
+		return nil
+	}
+
+	var owner *funcv1.AzureFunction
+	for _, obj := range sameHost {
+		other, ok := obj.(*funcv1.AzureFunction)
+		if !ok || (other.Namespace == function.Namespace && other.Name == function.Name) {
+			continue
+		}
+
+		if !overlapsAny(route, other.Spec.IngressRoutes()) {
+			continue
+		}
+
+		if precedes(other, function) && (owner == nil || precedes(other, owner)) {
+			owner = other
+		}
+	}
+
+	return owner
+}
+
+func overlapsAny(route funcv1.Route, routes []funcv1.Route) bool {
+	for _, other := range routes {
+		if route.Overlaps(other) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// precedes orders functions by creation time, then by namespace and name
+func precedes(a *funcv1.AzureFunction, b *funcv1.AzureFunction) bool {
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
+	}
+
+	return a.Namespace+"/"+a.Name < b.Namespace+"/"+b.Name
+}
+
+// deleteStaleIngresses removes the Ingresses of a function that no route is
+// rendered into anymore. They are listed from the cache, so functions
+// without stale Ingresses don't cost any API call
+func (t *AzureFunctionsHandler) deleteStaleIngresses(function *funcv1.AzureFunction, desired map[string]bool) error {
+	selector := labels.SelectorFromSet(labels.Set{
+		functionNameLabel:      function.Name,
+		functionNamespaceLabel: function.Namespace,
+	})
+
+	namespace := t.workloadNamespace(function)
+
+	ingresses, err := t.IngressesLister.Ingresses(namespace).List(selector)
+	if err != nil {
+		return err
+	}
+
+	for _, ingress := range ingresses {
+		if desired[ingress.Name] {
+			continue
+		}
+
+		err = clientSet.ExtensionsV1beta1().Ingresses(namespace).Delete(ingress.Name, &metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RouteConflictEventHandler enqueues the functions that share a host with a
+// function whose routes are changed or that is deleted. A function whose
+// route was held by it is routed as soon as the route is released, and a
+// function that now has to give up a route to it stops serving it
+func (t *AzureFunctionsHandler) RouteConflictEventHandler(queue workqueue.Interface, functions cache.Indexer) cache.ResourceEventHandler {
+	enqueueSharing := func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+
+		function, ok := obj.(*funcv1.AzureFunction)
+		if !ok {
+			return
+		}
+
+		keys, _ := t.RoutesIndexFunc(function)
+		for _, key := range keys {
+			sharing, err := functions.ByIndex(RoutesIndex, key)
+			if err != nil {
+				continue
+			}
+
+			for _, other := range sharing {
+				otherKey, err := cache.MetaNamespaceKeyFunc(other)
+				if err == nil && otherKey != function.Namespace+"/"+function.Name {
+					queue.Add(otherKey)
+				}
+			}
+		}
+	}
+
+	return cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldFunc := oldObj.(*funcv1.AzureFunction)
+			newFunc := newObj.(*funcv1.AzureFunction)
+
+			if oldFunc.Spec.AccessPolicy == newFunc.Spec.AccessPolicy && apiequality.Semantic.DeepEqual(oldFunc.Spec.IngressRoutes(), newFunc.Spec.IngressRoutes()) {
+				return
+			}
+
+			// the old routes may have been released and the new ones
+			// may be held by a younger function
+			enqueueSharing(oldObj)
+			enqueueSharing(newObj)
+		},
+		DeleteFunc: enqueueSharing,
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"github.com/yaron2/azfuncs/config"
+	funcv1 "github.com/yaron2/azfuncs/pkg/apis/azurefunctions/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// burstLabel marks the pods of the burst Deployment of a function, so they
+// can be told apart from the pods of its main Deployment
+const burstLabel = "azurefunctions.dev.azure.com/burst"
+
+func burstDeploymentName(name string) string { return name + "-burst" }
+
+// applyScheduling sets the scheduling fields of a function pod. Each field
+// set in the spec of the function replaces the default profile of the
+// controller for that field
+func applyScheduling(function *funcv1.AzureFunction, workload config.WorkloadConfig, spec *apiv1.PodSpec) {
+	spec.NodeSelector = workload.NodeSelector
+	if function.Spec.NodeSelector != nil {
+		spec.NodeSelector = function.Spec.NodeSelector
+	}
+
+	spec.Affinity = workload.Affinity
+	if function.Spec.Affinity != nil {
+		spec.Affinity = function.Spec.Affinity
+	}
+
+	spec.Tolerations = workload.Tolerations
+	if function.Spec.Tolerations != nil {
+		spec.Tolerations = function.Spec.Tolerations
+	}
+
+	spec.TopologySpreadConstraints = workload.TopologySpreadConstraints
+	if function.Spec.TopologySpreadConstraints != nil {
+		spec.TopologySpreadConstraints = function.Spec.TopologySpreadConstraints
+	}
+}
+
+// excludeVirtualNodes requires the pods to run on nodes that don't carry the
+// labels of virtual nodes, in addition to any node affinity they already have
+func excludeVirtualNodes(spec *apiv1.PodSpec, virtualNodes config.VirtualNodesConfig) {
+	requirements := []apiv1.NodeSelectorRequirement{}
+	for key, value := range virtualNodes.NodeSelector {
+		requirements = append(requirements, apiv1.NodeSelectorRequirement{
+			Key:      key,
+			Operator: apiv1.NodeSelectorOpNotIn,
+			Values:   []string{value},
+		})
+	}
+
+	// the affinity may be shared with the spec or the configuration
+	affinity := spec.Affinity.DeepCopy()
+	if affinity == nil {
+		affinity = &apiv1.Affinity{}
+	}
+
+	if affinity.NodeAffinity == nil {
+		affinity.NodeAffinity = &apiv1.NodeAffinity{}
+	}
+
+	required := affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if required == nil || len(required.NodeSelectorTerms) == 0 {
+		required = &apiv1.NodeSelector{
+			NodeSelectorTerms: []apiv1.NodeSelectorTerm{{}},
+		}
+	}
+
+	// terms are ORed, so every one of them has to exclude virtual nodes
+	for i := range required.NodeSelectorTerms {
+		term := &required.NodeSelectorTerms[i]
+		term.MatchExpressions = append(term.MatchExpressions, requirements...)
+	}
+
+	affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = required
+	spec.Affinity = affinity
+}
+
+// mainSelector selects the pods of the main Deployment of a function but not
+// the pods of its burst Deployment. The autoscaler finds the replicas of the
+// main Deployment through its selector, so burst replicas aren't counted as
+// main ones
+func mainSelector(function *funcv1.AzureFunction) *metav1.LabelSelector {
+	return &metav1.LabelSelector{
+		MatchLabels: map[string]string{
+			"app": function.ObjectMeta.Name,
+		},
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{
+				Key:      burstLabel,
+				Operator: metav1.LabelSelectorOpNotIn,
+				Values:   []string{"true"},
+			},
+		},
+	}
+}
+
+// minReplicas is the number of replicas the main Deployment of a function
+// never goes below. An autoscaler can't scale below a single replica
+func minReplicas(function *funcv1.AzureFunction) int32 {
+	min := function.Spec.MinReplicas()
+	if min == nil || *min < 1 {
+		return 1
+	}
+
+	return *min
+}
+
+// floorReplicas makes the main Deployment run at least min replicas, before
+// the autoscaler has acted on a new Deployment too. They are kept off virtual
+// nodes, so with burst enabled min replicas run on real nodes while there is
+// room
+func (t *AzureFunctionsHandler) floorReplicas(function *funcv1.AzureFunction, desired *appsv1.Deployment) {
+	min := minReplicas(function)
+
+	existing, err := t.DeploymentsLister.Deployments(desired.Namespace).Get(desired.Name)
+	if err == nil && existing.Spec.Replicas != nil && *existing.Spec.Replicas >= min {
+		return
+	}
+
+	desired.Spec.Replicas = int32Ptr(min)
+}
+
+// desiredBurstDeployment builds the Deployment that runs the replicas of the
+// main Deployment that can't be scheduled on real nodes. Its pods only run on
+// virtual nodes, which don't take the affinity or spread constraints of the
+// function into account
+func (t *AzureFunctionsHandler) desiredBurstDeployment(function *funcv1.AzureFunction, main *appsv1.Deployment, replicas int32) *appsv1.Deployment {
+	virtualNodes := t.Config.Get().Workload.VirtualNodes
+
+	burst := main.DeepCopy()
+	burst.ObjectMeta = t.childObjectMeta(function, burstDeploymentName(function.Name))
+	burst.Spec.Replicas = int32Ptr(replicas)
+	burst.Spec.Selector = &metav1.LabelSelector{
+		MatchLabels: map[string]string{
+			"app":      function.ObjectMeta.Name,
+			burstLabel: "true",
+		},
+	}
+
+	burst.Spec.Template.Labels[burstLabel] = "true"
+
+	spec := &burst.Spec.Template.Spec
+	spec.NodeSelector = virtualNodes.NodeSelector
+	spec.Affinity = nil
+	spec.TopologySpreadConstraints = nil
+	spec.Tolerations = append(append([]apiv1.Toleration{}, spec.Tolerations...), virtualNodes.Tolerations...)
+
+	return burst
+}
+
+// reconcileBurst runs the replicas of the function that the scheduler can't
+// place on real nodes on virtual nodes instead, and removes the burst
+// Deployment of functions without the VirtualNodes policy. It returns the
+// number of ready burst replicas
+func (t *AzureFunctionsHandler) reconcileBurst(function *funcv1.AzureFunction, main *appsv1.Deployment) (int32, error) {
+	namespace := t.workloadNamespace(function)
+	name := burstDeploymentName(function.Name)
+
+	if function.Spec.BurstPolicy != funcv1.BurstPolicyVirtualNodes {
+		_, err := t.DeploymentsLister.Deployments(namespace).Get(name)
+		if errors.IsNotFound(err) {
+			return 0, nil
+		}
+
+		err = clientSet.AppsV1().Deployments(namespace).Delete(name, &metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return 0, err
+		}
+
+		return 0, nil
+	}
+
+	burst, err := t.applyDeployment(t.desiredBurstDeployment(function, main, t.unschedulableReplicas(function)))
+	if err != nil {
+		return 0, err
+	}
+
+	return burst.Status.ReadyReplicas, nil
+}
+
+// unschedulableReplicas counts the pods of the main Deployment of a function
+// that the scheduler couldn't place. The autoscaler keeps at least min of
+// them, so min replicas always run on real nodes while there is room
+func (t *AzureFunctionsHandler) unschedulableReplicas(function *funcv1.AzureFunction) int32 {
+	selector := labels.SelectorFromSet(labels.Set{
+		functionNameLabel:      function.Name,
+		functionNamespaceLabel: function.Namespace,
+	})
+
+	pods, err := t.PodsLister.Pods(t.workloadNamespace(function)).List(selector)
+	if err != nil {
+		return 0
+	}
+
+	var unschedulable int32
+	for _, pod := range pods {
+		if pod.Labels[burstLabel] == "true" || pod.DeletionTimestamp != nil {
+			continue
+		}
+
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == apiv1.PodScheduled && condition.Status == apiv1.ConditionFalse && condition.Reason == apiv1.PodReasonUnschedulable {
+				unschedulable++
+			}
+		}
+	}
+
+	return unschedulable
+}
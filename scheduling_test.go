@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	funcv1 "github.com/yaron2/azfuncs/pkg/apis/azurefunctions/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func burstSpec(min int32) funcv1.AzureFunctionSpec {
+	return funcv1.AzureFunctionSpec{
+		Image:       "functions/orders:1",
+		Min:         int32Ptr(min),
+		BurstPolicy: funcv1.BurstPolicyVirtualNodes,
+	}
+}
+
+// addPod adds a pod of the function, scheduled or not, to the fake clientset
+func (e *testEnv) addPod(index int, burst bool, scheduled bool) {
+	e.t.Helper()
+
+	podLabels := map[string]string{
+		"app":                  testName,
+		functionNameLabel:      testName,
+		functionNamespaceLabel: testNamespace,
+		managedByLabel:         managedByValue,
+	}
+
+	if burst {
+		podLabels[burstLabel] = "true"
+	}
+
+	condition := apiv1.PodCondition{Type: apiv1.PodScheduled, Status: apiv1.ConditionTrue}
+	if !scheduled {
+		condition = apiv1.PodCondition{
+			Type:   apiv1.PodScheduled,
+			Status: apiv1.ConditionFalse,
+			Reason: apiv1.PodReasonUnschedulable,
+		}
+	}
+
+	_, err := e.kube.CoreV1().Pods(testNamespace).Create(&apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      testName + "-" + strconv.Itoa(index),
+			Namespace: testNamespace,
+			Labels:    podLabels,
+		},
+		Status: apiv1.PodStatus{
+			Conditions: []apiv1.PodCondition{condition},
+		},
+	})
+	if err != nil {
+		e.t.Fatal(err)
+	}
+}
+
+func selects(t *testing.T, selector *metav1.LabelSelector, podLabels map[string]string) bool {
+	t.Helper()
+
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s.Matches(labels.Set(podLabels))
+}
+
+// TestBurstPodsAreNotMainReplicas checks that the main Deployment, and so
+// the autoscaler, doesn't select the pods of the burst Deployment, while the
+// Service selects both
+func TestBurstPodsAreNotMainReplicas(t *testing.T) {
+	e := newTestEnv(t)
+	e.apply(burstSpec(1))
+
+	main := e.deployment(deploymentName(testName))
+	burst := e.deployment(burstDeploymentName(testName))
+	service := e.service()
+
+	if !selects(t, main.Spec.Selector, main.Spec.Template.Labels) {
+		t.Error("expected the main Deployment to select its own pods")
+	}
+
+	if selects(t, main.Spec.Selector, burst.Spec.Template.Labels) {
+		t.Error("expected the main Deployment not to select burst pods")
+	}
+
+	if !selects(t, burst.Spec.Selector, burst.Spec.Template.Labels) {
+		t.Error("expected the burst Deployment to select its own pods")
+	}
+
+	if selects(t, burst.Spec.Selector, main.Spec.Template.Labels) {
+		t.Error("expected the burst Deployment not to select main pods")
+	}
+
+	serviceSelector := &metav1.LabelSelector{MatchLabels: service.Spec.Selector}
+	if !selects(t, serviceSelector, main.Spec.Template.Labels) || !selects(t, serviceSelector, burst.Spec.Template.Labels) {
+		t.Error("expected the Service to select main and burst pods")
+	}
+}
+
+// TestMinReplicasRunOnRealNodes checks that min replicas are kept off virtual
+// nodes and that only the replicas the scheduler can't place are burst
+func TestMinReplicasRunOnRealNodes(t *testing.T) {
+	e := newTestEnv(t)
+	e.apply(burstSpec(3))
+
+	main := e.deployment(deploymentName(testName))
+	if main.Spec.Replicas == nil || *main.Spec.Replicas != 3 {
+		t.Fatalf("expected the main Deployment to run min replicas, got %v", main.Spec.Replicas)
+	}
+
+	affinity := main.Spec.Template.Spec.Affinity
+	if affinity == nil || affinity.NodeAffinity == nil || affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		t.Fatal("expected the main pods to require real nodes")
+	}
+
+	for _, term := range affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		excluded := false
+		for _, requirement := range term.MatchExpressions {
+			excluded = excluded || (requirement.Key == "type" && requirement.Operator == apiv1.NodeSelectorOpNotIn)
+		}
+
+		if !excluded {
+			t.Errorf("expected every node selector term to exclude virtual nodes, got %v", term)
+		}
+	}
+
+	if replicas := *e.deployment(burstDeploymentName(testName)).Spec.Replicas; replicas != 0 {
+		t.Errorf("expected no burst replica while every pod is scheduled, got %d", replicas)
+	}
+
+	// one main pod runs on a real node, two don't fit. A pending burst pod
+	// must not be counted
+	e.addPod(0, false, true)
+	e.addPod(1, false, false)
+	e.addPod(2, false, false)
+	e.addPod(3, true, false)
+	e.reconcile()
+
+	if replicas := *e.deployment(burstDeploymentName(testName)).Spec.Replicas; replicas != 2 {
+		t.Errorf("expected a burst replica for each unschedulable main pod, got %d", replicas)
+	}
+
+	if replicas := *e.deployment(deploymentName(testName)).Spec.Replicas; replicas != 3 {
+		t.Errorf("expected the main Deployment to keep min replicas, got %d", replicas)
+	}
+}
+
+// TestMinReplicasFloorsExistingDeployment checks that a Deployment scaled
+// below min is scaled up again, and one scaled above is left to the autoscaler
+func TestMinReplicasFloorsExistingDeployment(t *testing.T) {
+	e := newTestEnv(t)
+	e.apply(burstSpec(2))
+
+	for _, test := range []struct {
+		replicas int32
+		expected int32
+	}{
+		{replicas: 1, expected: 2},
+		{replicas: 5, expected: 5},
+	} {
+		deployment := e.deployment(deploymentName(testName))
+		deployment.Spec.Replicas = int32Ptr(test.replicas)
+
+		_, err := e.kube.AppsV1().Deployments(testNamespace).Update(deployment)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e.reconcile()
+
+		if replicas := *e.deployment(deploymentName(testName)).Spec.Replicas; replicas != test.expected {
+			t.Errorf("expected %d replicas after scaling to %d, got %d", test.expected, test.replicas, replicas)
+		}
+	}
+}
+
+// TestDeploymentWithOldSelectorIsReplaced checks that a Deployment created
+// with the selector of earlier versions is deleted and created again with the
+// current selector, which adopts the ReplicaSet of the old one. The fake
+// clientset doesn't record delete options, so the ReplicaSet is checked to
+// be left alone and to match the new selector instead
+func TestDeploymentWithOldSelectorIsReplaced(t *testing.T) {
+	podLabels := map[string]string{"app": testName}
+
+	old := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      deploymentName(testName),
+			Namespace: testNamespace,
+			Labels:    map[string]string{managedByLabel: managedByValue},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: podLabels},
+		},
+	}
+
+	replicaSet := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      deploymentName(testName) + "-1",
+			Namespace: testNamespace,
+			Labels:    podLabels,
+		},
+		Spec: appsv1.ReplicaSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: podLabels},
+			Template: apiv1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: podLabels},
+			},
+		},
+	}
+
+	e := newTestEnv(t, old, replicaSet)
+
+	function := &funcv1.AzureFunction{
+		ObjectMeta: metav1.ObjectMeta{Name: testName, Namespace: testNamespace},
+		Spec:       burstSpec(1),
+	}
+
+	_, err := e.functions.DevV1().AzureFunctions(testNamespace).Create(function)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.sync()
+
+	_, err = e.handler.Reconcile(context.Background(), testNamespace+"/"+testName)
+	if err == nil {
+		t.Fatal("expected the reconcile to wait for the Deployment to be replaced")
+	}
+
+	for _, action := range e.kube.Actions() {
+		if action.GetVerb() == "delete" && action.GetResource().Resource != "deployments" {
+			t.Errorf("expected only the Deployment to be deleted, got %v", action)
+		}
+	}
+
+	_, err = e.kube.AppsV1().Deployments(testNamespace).Get(deploymentName(testName), metav1.GetOptions{})
+	if !errors.IsNotFound(err) {
+		t.Fatalf("expected the Deployment with the old selector to be deleted, got %v", err)
+	}
+
+	e.reconcile()
+
+	selector := e.deployment(deploymentName(testName)).Spec.Selector
+	if len(selector.MatchExpressions) != 1 || selector.MatchExpressions[0].Key != burstLabel {
+		t.Errorf("expected the selector to exclude burst pods, got %v", selector)
+	}
+
+	existing, err := e.kube.AppsV1().ReplicaSets(testNamespace).Get(replicaSet.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected the ReplicaSet of the old Deployment to be left alone: %v", err)
+	}
+
+	if !selects(t, selector, existing.Spec.Template.Labels) {
+		t.Errorf("expected the new Deployment to adopt the pods of the old one, got selector %v", selector)
+	}
+
+	_, err = e.kube.AppsV1().Deployments(testNamespace).Get(burstDeploymentName(testName), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		t.Error("expected the burst Deployment to be created")
+	}
+}
@@ -1,24 +1,30 @@
 package utils
 
 import (
-	"flag"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"strings"
 
+	log "github.com/Sirupsen/logrus"
+	"github.com/yaron2/azfuncs/logging"
 	"k8s.io/client-go/rest"
 
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/client-go/util/homedir"
 )
 
 var clientSet *kubernetes.Clientset
 var kubeConfig *rest.Config
+var kubeconfigPath string
+
+// SetKubeconfig sets the kubeconfig used when not running in a cluster. It
+// must be called before the first client is created
+func SetKubeconfig(path string) {
+	kubeconfigPath = path
+}
 
 func GetYAMLStringFromURL(url string) (string, error) {
 	resp, err := http.Get(url)
@@ -45,18 +51,10 @@ func initKubeConfig() {
 
 func GetConfig() *rest.Config {
 	if kubeConfig == nil {
-		var kubeconfig *string
-		if home := homedir.HomeDir(); home != "" {
-			kubeconfig = flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
-		} else {
-			kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
-		}
-		flag.Parse()
-
 		conf, err := rest.InClusterConfig()
 		if err != nil {
-			fmt.Println("ERR - " + err.Error())
-			conf, err = clientcmd.BuildConfigFromFlags("", *kubeconfig)
+			log.Warnf("GetConfig: not running in a cluster, using kubeconfig %s: %v", kubeconfigPath, err)
+			conf, err = clientcmd.BuildConfigFromFlags("", kubeconfigPath)
 			if err != nil {
 				panic(err)
 			}
@@ -76,11 +74,23 @@ func GetKubeClient() *kubernetes.Clientset {
 	return clientSet
 }
 
-func RunCMD(cmd string, args []string) {
-	err := exec.Command(cmd, args...).Run()
+// RunCMD runs a command and logs its combined output, so the result of
+// installing a component shows up in the controller logs under the name of
+// the component
+func RunCMD(component string, cmd string, args []string) {
+	logger := log.WithFields(log.Fields{
+		logging.FieldComponent: component,
+		"cmd":                  cmd,
+		"args":                 strings.Join(args, " "),
+	})
+
+	output, err := exec.Command(cmd, args...).CombinedOutput()
 	if err != nil {
-		fmt.Println(err.Error())
+		logger.WithField("output", string(output)).Errorf("RunCMD: %v", err)
+		return
 	}
+
+	logger.WithField("output", string(output)).Info("RunCMD: completed")
 }
 
 func DownloadFile(filepath string, url string) error {
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/yaron2/azfuncs/components"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// FunctionKeysForObject returns the keys of the functions that have to be
+// reconciled when a watched object changes or disappears: the function the
+// object was created for, or every routed function when it is the service
+// of the ingress controller
+func (t *AzureFunctionsHandler) FunctionKeysForObject(obj interface{}) []string {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	object, ok := obj.(metav1.Object)
+	if !ok {
+		return nil
+	}
+
+	name, hasName := object.GetLabels()[functionNameLabel]
+	namespace, hasNamespace := object.GetLabels()[functionNamespaceLabel]
+	if hasName && hasNamespace {
+		return []string{namespace + "/" + name}
+	}
+
+	service, ok := obj.(*apiv1.Service)
+	if !ok {
+		return nil
+	}
+
+	ingressComponent := t.ConfiguredIngressComponent()
+	if ingressComponent == nil || service.Namespace != ingressComponent.Namespace() || service.Name != ingressComponent.ServiceName() {
+		return nil
+	}
+
+	functions, err := t.FunctionsLister.List(labels.Everything())
+	if err != nil {
+		return nil
+	}
+
+	keys := []string{}
+	for _, function := range functions {
+		if len(function.Spec.IngressRoutes()) > 0 {
+			keys = append(keys, function.Namespace+"/"+function.Name)
+		}
+	}
+
+	return keys
+}
+
+// ConfiguredIngressComponent returns the ingress component selected by the
+// configuration, whether or not it has been installed yet. Components are
+// registered before any event handler runs, so unlike IngressComponent this
+// doesn't race with Init
+func (t *AzureFunctionsHandler) ConfiguredIngressComponent() components.IngressComponent {
+	if t.Ingress == "" {
+		return nil
+	}
+
+	component, err := components.GetComponent(strings.ToLower(t.Ingress))
+	if err != nil {
+		return nil
+	}
+
+	ingressComponent, ok := component.(components.IngressComponent)
+	if !ok {
+		return nil
+	}
+
+	return ingressComponent
+}
+
+// OwnedResourceEventHandler enqueues the parent function whenever a resource
+// created for it is added, changed or deleted, so drift is reverted by the
+// next reconcile
+func (t *AzureFunctionsHandler) OwnedResourceEventHandler(queue workqueue.Interface) cache.ResourceEventHandler {
+	enqueue := func(obj interface{}) {
+		for _, key := range t.FunctionKeysForObject(obj) {
+			queue.Add(key)
+		}
+	}
+
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			// periodic resyncs are handled by the function informer
+			if oldObj.(metav1.Object).GetResourceVersion() == newObj.(metav1.Object).GetResourceVersion() {
+				return
+			}
+
+			enqueue(newObj)
+		},
+		DeleteFunc: enqueue,
+	}
+}
+
+// ComponentInformers returns the informers the configured ingress and mesh
+// components read the cluster from, so they are started and synced along
+// with the informers of the controller
+func (t *AzureFunctionsHandler) ComponentInformers(client kubernetes.Interface) []cache.SharedIndexInformer {
+	informers := []cache.SharedIndexInformer{}
+
+	for _, name := range []string{t.Ingress, t.Mesh} {
+		if name == "" {
+			continue
+		}
+
+		component, err := components.GetComponent(strings.ToLower(name))
+		if err != nil {
+			continue
+		}
+
+		if informerComponent, ok := component.(components.InformerComponent); ok {
+			informers = append(informers, informerComponent.Informers(client)...)
+		}
+	}
+
+	return informers
+}
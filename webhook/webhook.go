@@ -0,0 +1,264 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	admissionv1 "k8s.io/api/admission/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	funcv1 "github.com/yaron2/azfuncs/pkg/apis/azurefunctions/v1"
+	listers "github.com/yaron2/azfuncs/pkg/client/listers/azurefunctions/v1"
+	"github.com/yaron2/azfuncs/pkg/validation"
+)
+
+// Server serves the validating and mutating admission webhooks for
+// AzureFunction objects over TLS
+type Server struct {
+	Port     int
+	CertFile string
+	KeyFile  string
+	Lister   listers.AzureFunctionLister
+}
+
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// Handler returns the HTTP routes of the webhook, without TLS
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/validate", s.serve(s.validate))
+	mux.HandleFunc("/mutate", s.serve(s.mutate))
+	return mux
+}
+
+// Run blocks serving the webhook until the server fails
+func (s *Server) Run() error {
+	log.Infof("Webhook.Run: listening on port %d", s.Port)
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", s.Port),
+		Handler: s.Handler(),
+	}
+
+	return server.ListenAndServeTLS(s.CertFile, s.KeyFile)
+}
+
+func (s *Server) serve(admit func(*admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		review := admissionv1.AdmissionReview{}
+		err = json.Unmarshal(body, &review)
+		if err != nil || review.Request == nil {
+			http.Error(w, "malformed admission review", http.StatusBadRequest)
+			return
+		}
+
+		response := admit(review.Request)
+		response.UID = review.Request.UID
+		review.Response = response
+		review.Request = nil
+
+		resp, err := json.Marshal(review)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(resp)
+	}
+}
+
+func (s *Server) validate(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	function, err := decodeFunction(req)
+	if err != nil {
+		return deny(err.Error())
+	}
+
+	var old *funcv1.AzureFunction
+	if req.Operation == admissionv1.Update {
+		old, err = decodeOldFunction(req)
+		if err != nil {
+			return deny(err.Error())
+		}
+
+		// finalizer and metadata writes must go through whatever the spec
+		// holds, or an object that became invalid can never be deleted
+		if function.DeletionTimestamp != nil || apiequality.Semantic.DeepEqual(old.Spec, function.Spec) {
+			return &admissionv1.AdmissionResponse{Allowed: true}
+		}
+	}
+
+	allErrs := validation.ValidateAzureFunction(function)
+
+	if s.Lister != nil {
+		existing, err := s.Lister.List(labels.Everything())
+		if err != nil {
+			return deny("Error listing functions - " + err.Error())
+		}
+
+		allErrs = append(allErrs, validation.ValidateRoutesUnique(function, old, existing)...)
+	}
+
+	if len(allErrs) > 0 {
+		log.Infof("Webhook.validate: rejected %s/%s: %v", function.Namespace, function.Name, allErrs.ToAggregate())
+		return deny(allErrs.ToAggregate().Error())
+	}
+
+	return &admissionv1.AdmissionResponse{Allowed: true}
+}
+
+func (s *Server) mutate(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	function, err := decodeFunction(req)
+	if err != nil {
+		return deny(err.Error())
+	}
+
+	original, err := toMap(function.Spec)
+	if err != nil {
+		return deny(err.Error())
+	}
+
+	validation.SetDefaults(function)
+
+	defaulted, err := toMap(function.Spec)
+	if err != nil {
+		return deny(err.Error())
+	}
+
+	response := &admissionv1.AdmissionResponse{Allowed: true}
+
+	patches := diffPatches("/spec", original, defaulted)
+	if len(patches) == 0 {
+		return response
+	}
+
+	patch, err := json.Marshal(patches)
+	if err != nil {
+		return deny(err.Error())
+	}
+
+	patchType := admissionv1.PatchTypeJSONPatch
+	response.Patch = patch
+	response.PatchType = &patchType
+
+	return response
+}
+
+// toMap returns the JSON form of a value as a generic map, which is what the
+// patches are computed on
+func toMap(value interface{}) (map[string]interface{}, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	out := map[string]interface{}{}
+	err = json.Unmarshal(raw, &out)
+	return out, err
+}
+
+// diffPatches returns the JSON patch operations that turn the original object
+// into the modified one. Nested objects are patched field by field, anything
+// else is replaced as a whole
+func diffPatches(path string, original map[string]interface{}, modified map[string]interface{}) []patchOperation {
+	patches := []patchOperation{}
+
+	keys := []string{}
+	for key := range modified {
+		keys = append(keys, key)
+	}
+	for key := range original {
+		if _, ok := modified[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+
+	// sorted so that the same change always yields the same patch
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fieldPath := path + "/" + escapePointer(key)
+		before, inOriginal := original[key]
+		after, inModified := modified[key]
+
+		switch {
+		case !inModified:
+			patches = append(patches, patchOperation{Op: "remove", Path: fieldPath})
+		case !inOriginal:
+			patches = append(patches, patchOperation{Op: "add", Path: fieldPath, Value: after})
+		case !reflect.DeepEqual(before, after):
+			beforeMap, beforeIsMap := before.(map[string]interface{})
+			afterMap, afterIsMap := after.(map[string]interface{})
+			if beforeIsMap && afterIsMap {
+				patches = append(patches, diffPatches(fieldPath, beforeMap, afterMap)...)
+			} else {
+				patches = append(patches, patchOperation{Op: "replace", Path: fieldPath, Value: after})
+			}
+		}
+	}
+
+	return patches
+}
+
+// escapePointer escapes a key for use in a JSON pointer, see RFC 6901
+func escapePointer(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
+
+func decodeFunction(req *admissionv1.AdmissionRequest) (*funcv1.AzureFunction, error) {
+	function := &funcv1.AzureFunction{}
+	err := json.Unmarshal(req.Object.Raw, function)
+	if err != nil {
+		return nil, fmt.Errorf("can't decode AzureFunction: %v", err)
+	}
+
+	// the namespace is only carried on the request for objects that omit it
+	if function.Namespace == "" {
+		function.Namespace = req.Namespace
+	}
+
+	return function, nil
+}
+
+func decodeOldFunction(req *admissionv1.AdmissionRequest) (*funcv1.AzureFunction, error) {
+	old := &funcv1.AzureFunction{}
+	err := json.Unmarshal(req.OldObject.Raw, old)
+	if err != nil {
+		return nil, fmt.Errorf("can't decode the stored AzureFunction: %v", err)
+	}
+
+	if old.Namespace == "" {
+		old.Namespace = req.Namespace
+	}
+
+	return old, nil
+}
+
+func deny(message string) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonInvalid,
+			Message: message,
+		},
+	}
+}
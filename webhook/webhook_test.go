@@ -0,0 +1,364 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+
+	funcv1 "github.com/yaron2/azfuncs/pkg/apis/azurefunctions/v1"
+	listers "github.com/yaron2/azfuncs/pkg/client/listers/azurefunctions/v1"
+)
+
+func int32Ptr(i int32) *int32 { return &i }
+
+func newFunction(name string, routes ...funcv1.Route) *funcv1.AzureFunction {
+	return &funcv1.AzureFunction{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+		},
+		Spec: funcv1.AzureFunctionSpec{
+			Image:  "functions/" + name,
+			Routes: routes,
+		},
+	}
+}
+
+func newServer(t *testing.T, existing ...*funcv1.AzureFunction) *httptest.Server {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, function := range existing {
+		if err := indexer.Add(function); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &Server{Lister: listers.NewAzureFunctionLister(indexer)}
+	return httptest.NewServer(s.Handler())
+}
+
+func review(t *testing.T, server *httptest.Server, path string, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	req.UID = types.UID("request")
+
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request:  req,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post(server.URL+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s returned %d", path, resp.StatusCode)
+	}
+
+	out := admissionv1.AdmissionReview{}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.Response == nil || out.Response.UID != req.UID {
+		t.Fatalf("%s returned no response for the request", path)
+	}
+
+	return out.Response
+}
+
+func raw(t *testing.T, function *funcv1.AzureFunction) runtime.RawExtension {
+	body, err := json.Marshal(function)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return runtime.RawExtension{Raw: body}
+}
+
+func TestValidate(t *testing.T) {
+	minAboveMax := newFunction("scaled")
+	minAboveMax.Spec.Min = int32Ptr(5)
+	minAboveMax.Spec.Max = int32Ptr(2)
+
+	privateRouted := newFunction("private", funcv1.Route{Path: "/private"})
+	privateRouted.Spec.AccessPolicy = funcv1.AccessPolicyPrivate
+
+	noImage := newFunction("noimage")
+	noImage.Spec.Image = ""
+
+	tests := []struct {
+		name     string
+		function *funcv1.AzureFunction
+		allowed  bool
+	}{
+		{"valid", newFunction("valid", funcv1.Route{Path: "/valid"}), true},
+		{"min above max", minAboveMax, false},
+		{"private with routes", privateRouted, false},
+		{"no image", noImage, false},
+		{"overlapping routes", newFunction("overlapping", funcv1.Route{Path: "/api/"}, funcv1.Route{Path: "/api/orders", PathType: funcv1.PathTypeExact}), false},
+		{"same path with another path type", newFunction("samepath", funcv1.Route{Path: "/api"}, funcv1.Route{Path: "/api", PathType: funcv1.PathTypeExact}), false},
+		{"exact route next to a prefix", newFunction("exact", funcv1.Route{Path: "/api/orders", PathType: funcv1.PathTypeExact}, funcv1.Route{Path: "/api/orders/"}), true},
+		{"path with a quote", newFunction("quoted", funcv1.Route{Path: `/orders"`}), false},
+	}
+
+	server := newServer(t)
+	defer server.Close()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := review(t, server, "/validate", &admissionv1.AdmissionRequest{
+				Operation: admissionv1.Create,
+				Namespace: "default",
+				Object:    raw(t, test.function),
+			})
+
+			if resp.Allowed != test.allowed {
+				t.Fatalf("expected allowed=%v, got %v: %v", test.allowed, resp.Allowed, resp.Result)
+			}
+
+			if !resp.Allowed && (resp.Result == nil || resp.Result.Reason != metav1.StatusReasonInvalid) {
+				t.Fatalf("expected a denial with reason Invalid, got %v", resp.Result)
+			}
+		})
+	}
+}
+
+func TestValidateRouteUniqueness(t *testing.T) {
+	holder := newFunction("holder", funcv1.Route{Path: "/orders"})
+	holder.CreationTimestamp = metav1.NewTime(time.Unix(0, 0))
+
+	// a function that got the route of holder before the webhook was enabled
+	sharing := newFunction("sharing", funcv1.Route{Path: "/orders"})
+
+	finalized := sharing.DeepCopy()
+	finalized.Finalizers = []string{"azurefunctions.dev.azure.com"}
+
+	scaled := sharing.DeepCopy()
+	scaled.Spec.Max = int32Ptr(10)
+
+	extended := sharing.DeepCopy()
+	extended.Spec.Routes = append(extended.Spec.Routes, funcv1.Route{Path: "/invoices"})
+
+	claiming := newFunction("claiming", funcv1.Route{Path: "/invoices"})
+	stealing := claiming.DeepCopy()
+	stealing.Spec.Routes = append(stealing.Spec.Routes, funcv1.Route{Path: "/orders"})
+
+	// removing the finalizer of a function being deleted is a write too
+	deleting := stealing.DeepCopy()
+	deleting.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+
+	otherHost := newFunction("otherhost", funcv1.Route{Host: "orders.example.com", Path: "/orders"})
+
+	private := sharing.DeepCopy()
+	private.Spec.AccessPolicy = funcv1.AccessPolicyPrivate
+	private.Spec.Routes = nil
+	public := newFunction("sharing", funcv1.Route{Path: "/orders"})
+
+	tests := []struct {
+		name      string
+		operation admissionv1.Operation
+		old       *funcv1.AzureFunction
+		function  *funcv1.AzureFunction
+		allowed   bool
+	}{
+		{"create claiming a held route", admissionv1.Create, nil, newFunction("new", funcv1.Route{Path: "/orders"}), false},
+		{"create on another host", admissionv1.Create, nil, otherHost, true},
+		{"create on a free route", admissionv1.Create, nil, claiming, true},
+		{"create below a held prefix", admissionv1.Create, nil, newFunction("archive", funcv1.Route{Path: "/orders/archive"}), true},
+		{"create with an exact route below a held prefix", admissionv1.Create, nil, newFunction("list", funcv1.Route{Path: "/orders/list", PathType: funcv1.PathTypeExact}), false},
+		{"create with an exact route on a held path", admissionv1.Create, nil, newFunction("exact", funcv1.Route{Path: "/orders", PathType: funcv1.PathTypeExact}), false},
+		{"create with a prefix above a held prefix", admissionv1.Create, nil, newFunction("root", funcv1.Route{Path: "/"}), true},
+		{"update adding a finalizer", admissionv1.Update, sharing, finalized, true},
+		{"update of a function being deleted", admissionv1.Update, claiming, deleting, true},
+		{"update keeping a shared route", admissionv1.Update, sharing, scaled, true},
+		{"update adding a free route", admissionv1.Update, sharing, extended, true},
+		{"update adding a held route", admissionv1.Update, claiming, stealing, false},
+		{"update making a private function public", admissionv1.Update, private, public, false},
+	}
+
+	server := newServer(t, holder, sharing)
+	defer server.Close()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := &admissionv1.AdmissionRequest{
+				Operation: test.operation,
+				Namespace: "default",
+				Object:    raw(t, test.function),
+			}
+
+			if test.old != nil {
+				req.OldObject = raw(t, test.old)
+			}
+
+			resp := review(t, server, "/validate", req)
+			if resp.Allowed != test.allowed {
+				t.Fatalf("expected allowed=%v, got %v: %v", test.allowed, resp.Allowed, resp.Result)
+			}
+		})
+	}
+}
+
+func TestValidateAdmitsUnchangedInvalidSpec(t *testing.T) {
+	// a function stored before min and max were checked
+	invalid := newFunction("invalid")
+	invalid.Spec.Min = int32Ptr(5)
+	invalid.Spec.Max = int32Ptr(2)
+
+	labeled := invalid.DeepCopy()
+	labeled.Labels = map[string]string{"team": "orders"}
+
+	server := newServer(t)
+	defer server.Close()
+
+	resp := review(t, server, "/validate", &admissionv1.AdmissionRequest{
+		Operation: admissionv1.Update,
+		Namespace: "default",
+		Object:    raw(t, labeled),
+		OldObject: raw(t, invalid),
+	})
+
+	if !resp.Allowed {
+		t.Fatalf("expected a metadata update to be allowed, got %v", resp.Result)
+	}
+}
+
+func TestMutate(t *testing.T) {
+	defaulted := newFunction("defaulted")
+	defaulted.Spec.AccessPolicy = funcv1.AccessPolicyPrivate
+	defaulted.Spec.Min = int32Ptr(2)
+	defaulted.Spec.Max = int32Ptr(4)
+	defaulted.Spec.Port = int32Ptr(8080)
+	defaulted.Spec.Protocol = funcv1.ProtocolGRPC
+	defaulted.Spec.BurstPolicy = funcv1.BurstPolicyVirtualNodes
+
+	partial := newFunction("partial")
+	partial.Spec.Port = int32Ptr(8080)
+	partial.Spec.Protocol = funcv1.ProtocolHTTP2
+
+	tests := []struct {
+		name     string
+		function *funcv1.AzureFunction
+		patches  map[string]interface{}
+	}{
+		{
+			name:     "empty spec",
+			function: newFunction("empty"),
+			patches: map[string]interface{}{
+				"/spec/accessPolicy": funcv1.AccessPolicyPublic,
+				"/spec/min":          float64(1),
+				"/spec/max":          float64(1000),
+				"/spec/port":         float64(80),
+				"/spec/protocol":     funcv1.ProtocolHTTP,
+				"/spec/burstPolicy":  funcv1.BurstPolicyNone,
+			},
+		},
+		{
+			name:     "partial spec",
+			function: partial,
+			patches: map[string]interface{}{
+				"/spec/accessPolicy": funcv1.AccessPolicyPublic,
+				"/spec/min":          float64(1),
+				"/spec/max":          float64(1000),
+				"/spec/burstPolicy":  funcv1.BurstPolicyNone,
+			},
+		},
+		{
+			name:     "fully set spec",
+			function: defaulted,
+			patches:  map[string]interface{}{},
+		},
+	}
+
+	server := newServer(t)
+	defer server.Close()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := review(t, server, "/mutate", &admissionv1.AdmissionRequest{
+				Operation: admissionv1.Create,
+				Namespace: "default",
+				Object:    raw(t, test.function),
+			})
+
+			if !resp.Allowed {
+				t.Fatalf("expected the request to be allowed, got %v", resp.Result)
+			}
+
+			if len(test.patches) == 0 {
+				if resp.Patch != nil {
+					t.Fatalf("expected no patch, got %s", resp.Patch)
+				}
+				return
+			}
+
+			if resp.PatchType == nil || *resp.PatchType != admissionv1.PatchTypeJSONPatch {
+				t.Fatalf("expected a JSON patch, got %v", resp.PatchType)
+			}
+
+			patches := []patchOperation{}
+			if err := json.Unmarshal(resp.Patch, &patches); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(patches) != len(test.patches) {
+				t.Fatalf("expected %d patches, got %s", len(test.patches), resp.Patch)
+			}
+
+			for _, patch := range patches {
+				value, ok := test.patches[patch.Path]
+				if !ok || patch.Op != "add" || patch.Value != value {
+					t.Errorf("unexpected patch %s %s %v", patch.Op, patch.Path, patch.Value)
+				}
+			}
+		})
+	}
+}
+
+func TestDiffPatches(t *testing.T) {
+	original := map[string]interface{}{
+		"image":   "functions/orders",
+		"removed": "value",
+		"scale":   map[string]interface{}{"min": float64(1)},
+		"a/b":     "escaped",
+	}
+
+	modified := map[string]interface{}{
+		"image": "functions/invoices",
+		"scale": map[string]interface{}{"min": float64(1), "max": float64(3)},
+		"a/b":   "escaped",
+	}
+
+	expected := []patchOperation{
+		{Op: "replace", Path: "/spec/image", Value: "functions/invoices"},
+		{Op: "remove", Path: "/spec/removed"},
+		{Op: "add", Path: "/spec/scale/max", Value: float64(3)},
+	}
+
+	patches := diffPatches("/spec", original, modified)
+	if len(patches) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, patches)
+	}
+
+	for i := range expected {
+		if patches[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], patches[i])
+		}
+	}
+
+	if escapePointer("a/b~c") != "a~1b~0c" {
+		t.Errorf("expected a~1b~0c, got %s", escapePointer("a/b~c"))
+	}
+}